@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"godownloader/httpfile"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// readJobs :parse input file of -i, - reads stdin
+//
+// every url starts a line, option lines indented below it apply to that url:
+//
+//	https://example.com/a.iso
+//	  out=a.iso
+//	  mirror=https://mirror.example.com/a.iso
+//	  checksum=sha256:<hex>
+//	  header=Authorization: Bearer <token>
+//
+// blank lines and lines starting with # are skipped
+func readJobs(name string) ([]job, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return parseJobs(r)
+}
+
+func parseJobs(r io.Reader) ([]job, error) {
+	var jobs []job
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		text := strings.TrimSpace(line)
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// url line
+		if line[0] != ' ' && line[0] != '\t' {
+			jobs = append(jobs, job{src: text})
+			continue
+		}
+
+		// option line
+		if len(jobs) == 0 {
+			return nil, errors.Errorf("line %d: option without url", n)
+		}
+		j := &jobs[len(jobs)-1]
+		kv := strings.SplitN(text, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("line %d: option must be name=value", n)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "out":
+			j.dst = strings.TrimSpace(kv[1])
+		case "mirror":
+			j.mirrors = append(j.mirrors, strings.TrimSpace(kv[1]))
+		case "checksum":
+			sum, err := httpfile.ParseChecksum(strings.TrimSpace(kv[1]))
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", n)
+			}
+			j.checksum = sum
+		case "header":
+			k, v, err := parseHeader(kv[1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", n)
+			}
+			if j.header == nil {
+				j.header = make(http.Header)
+			}
+			j.header.Add(k, v)
+		default:
+			return nil, errors.Errorf("line %d: unknown option %s", n, kv[0])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// runBatch :download jobs, parallel files at the same time, and return
+// exit code of the batch, ExitChecksum when every failure is a checksum
+// mismatch
+func runBatch(ctx context.Context, jobs []job, dir string, cfg config, parallel int) int {
+	d := newBatchDisplay(len(jobs))
+	d.start()
+
+	// jobs of the same url share cache, never run them at the same time;
+	// jobs of the same output wait for each other once it is resolved
+	locks := make(map[string]*sync.Mutex)
+	for _, j := range jobs {
+		if locks[j.src] == nil {
+			locks[j.src] = &sync.Mutex{}
+		}
+	}
+	cfg.outputs = &outputLocks{held: make(map[string]*sync.Mutex)}
+
+	errs := make([]error, len(jobs))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				locks[jobs[i].src].Lock()
+				errs[i] = fetch(ctx, &jobs[i], dir, cfg, d)
+				if jobs[i].release != nil {
+					jobs[i].release()
+					jobs[i].release = nil
+				}
+				locks[jobs[i].src].Unlock()
+				d.finish(&jobs[i])
+			}
+		}()
+	}
+
+	for i := range jobs {
+		if ctx.Err() != nil {
+			errs[i] = ctx.Err()
+			continue
+		}
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	d.close()
+
+	// summary
+	var failed, mismatched int
+	for i, j := range jobs {
+		if errs[i] != nil {
+			failed++
+			if httpfile.IsChecksumMismatch(errs[i]) {
+				mismatched++
+			}
+			fmt.Fprintf(os.Stdout, "FAIL %s: %v\n", j.src, errs[i])
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "OK   %s -> %s\n", j.src, j.dst)
+	}
+	fmt.Fprintf(os.Stdout, "%d succeeded, %d failed\n", len(jobs)-failed, failed)
+
+	switch {
+	case ctx.Err() != nil:
+		fmt.Fprintln(os.Stderr, "download interrupted, run again to resume")
+		return ExitInterrupted
+	case failed > 0 && failed == mismatched:
+		// every file arrived, only verification failed
+		return ExitChecksum
+	case failed > 0:
+		return 1
+	}
+	return 0
+}
+
+// outputLocks :one lock per absolute output path of a batch
+type outputLocks struct {
+	mu   sync.Mutex
+	held map[string]*sync.Mutex
+}
+
+// lock :block until no other job saves to dst, return func to release it
+func (l *outputLocks) lock(dst string) (func(), error) {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not resolve output path: %s", dst)
+	}
+
+	l.mu.Lock()
+	m := l.held[dst]
+	if m == nil {
+		m = &sync.Mutex{}
+		l.held[dst] = m
+	}
+	l.mu.Unlock()
+
+	m.Lock()
+	return m.Unlock, nil
+}
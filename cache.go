@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"godownloader/httpfile"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// shortIDLen :digits of a cache id shown by cache list, any unique prefix
+// is accepted
+const shortIDLen = 12
+
+const cacheUsage = `cache subcommands, flags above go before "cache":
+  cache list
+        show url, size, progress and age of cached downloads
+  cache status <id>
+        show details of one cached download
+  cache resume <id>
+        continue a cached download
+  cache rm <id>...
+        remove cached downloads
+  cache prune [-older-than 7d] [-max-size 20GB]
+        remove downloads not touched for a while, then the oldest until the cache fits`
+
+// runCache :run cache subcommand args on cache dir root
+func runCache(ctx context.Context, args []string, root string, cfg config) {
+	if len(args) == 0 {
+		log.Fatal(cacheUsage)
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list", "ls":
+		failOnErr(cacheList(root))
+	case "status":
+		e, err := findCache(root, args)
+		failOnErr(err)
+		cacheStatus(e)
+	case "resume":
+		e, err := findCache(root, args)
+		failOnErr(err)
+		exitOnFetchErr(cacheResume(ctx, e, root, cfg))
+	case "rm":
+		if len(args) == 0 {
+			log.Fatal("cache rm: missing id")
+		}
+		for _, id := range args {
+			e, err := httpfile.FindCache(root, id)
+			failOnErr(err)
+			failOnErr(e.Remove())
+			printRemoved(e)
+		}
+	case "prune":
+		failOnErr(cachePrune(root, args))
+	default:
+		log.Fatalf("unknown cache subcommand %q\n%s", cmd, cacheUsage)
+	}
+}
+
+// findCache :entry named by the only argument of a subcommand
+func findCache(root string, args []string) (*httpfile.CacheEntry, error) {
+	if len(args) != 1 {
+		return nil, errors.New("exactly one cache id expected")
+	}
+	return httpfile.FindCache(root, args[0])
+}
+
+func cacheList(root string) error {
+	entries, err := httpfile.ListCache(root)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSIZE\tDONE\tAGE\tURL")
+	for _, e := range entries {
+		url := e.URL
+		switch {
+		case e.Owner != nil:
+			url += " (in use by " + e.Owner.String() + ")"
+		case !e.Resumable:
+			url = strings.TrimSpace(url + " (stale, could only be removed)")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", shortID(e.ID), entrySize(e), entryDone(e), age(time.Since(e.ModTime)), url)
+	}
+	return w.Flush()
+}
+
+func cacheStatus(e *httpfile.CacheEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "id:\t%s\n", e.ID)
+	fmt.Fprintf(w, "url:\t%s\n", e.URL)
+	fmt.Fprintf(w, "output:\t%s\n", e.Output)
+	fmt.Fprintf(w, "size:\t%s\n", entrySize(e))
+	fmt.Fprintf(w, "done:\t%s (%s)\n", entryDone(e), httpfile.ByteSize(e.Stored))
+	fmt.Fprintf(w, "on disk:\t%s\n", httpfile.ByteSize(e.Disk))
+	fmt.Fprintf(w, "modified:\t%s (%s ago)\n", e.ModTime.Format(time.RFC3339), age(time.Since(e.ModTime)))
+	fmt.Fprintf(w, "direct:\t%t\n", e.Direct)
+	fmt.Fprintf(w, "resumable:\t%t\n", e.Resumable)
+	if e.Owner != nil {
+		fmt.Fprintf(w, "in use by:\t%s\n", e.Owner)
+	}
+	fmt.Fprintf(w, "path:\t%s\n", e.Path)
+	w.Flush()
+}
+
+// cacheResume :continue e where and how it was started; mirrors and
+// checksum are not cached, a resumed download goes without them
+func cacheResume(ctx context.Context, e *httpfile.CacheEntry, root string, cfg config) error {
+	if !e.Resumable {
+		return errors.Errorf("cache entry %s is stale, remove it with cache rm", shortID(e.ID))
+	}
+
+	j := job{src: e.URL, dst: e.Output}
+	cfg.identity = e.Identity
+	cfg.direct = e.Direct
+	return fetch(ctx, &j, root, cfg, &barDisplay{})
+}
+
+func cachePrune(root string, args []string) error {
+	fs := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	olderThan := fs.String("older-than", "", "remove downloads not written for this long, e.g. 7d or 12h")
+	maxSize := fs.String("max-size", "", "then remove the oldest until the cache takes at most this, e.g. 20GB")
+	err := fs.Parse(args)
+	if err != nil {
+		return errors.Wrap(err, "cache prune")
+	}
+	if len(*olderThan) == 0 && len(*maxSize) == 0 {
+		return errors.New("cache prune: -older-than or -max-size expected")
+	}
+
+	var (
+		d    time.Duration
+		size httpfile.ByteSize
+	)
+	if len(*olderThan) != 0 {
+		d, err = parseAge(*olderThan)
+		if err != nil {
+			return err
+		}
+	}
+	if len(*maxSize) != 0 {
+		size, err = httpfile.ParseByteSize(*maxSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	removed, err := httpfile.PruneCache(root, d, int64(size))
+	for _, e := range removed {
+		printRemoved(e)
+	}
+	return err
+}
+
+// parseAge :duration like 90m or 12h, with d for days
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil || days < 0 {
+			return 0, errors.Errorf("invalid age: %s", s)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, errors.Errorf("invalid age: %s", s)
+	}
+	return d, nil
+}
+
+// age :d rounded to its largest unit, like 3d or 5h
+func age(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+func printRemoved(e *httpfile.CacheEntry) {
+	fmt.Println(strings.TrimSpace("removed " + shortID(e.ID) + " " + e.URL))
+}
+
+func shortID(id string) string {
+	if len(id) > shortIDLen {
+		return id[:shortIDLen]
+	}
+	return id
+}
+
+func entrySize(e *httpfile.CacheEntry) string {
+	if e.Size < 0 {
+		return "unknown"
+	}
+	return httpfile.ByteSize(e.Size).String()
+}
+
+func entryDone(e *httpfile.CacheEntry) string {
+	p := e.Percent()
+	if p < 0 {
+		return httpfile.ByteSize(e.Stored).String()
+	}
+	return fmt.Sprintf("%.1f%%", p)
+}
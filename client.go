@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// safeHeaders :headers which are no credentials, sent to any host a
+// download is redirected to
+var safeHeaders = map[string]bool{
+	"User-Agent":      true,
+	"Referer":         true,
+	"Accept":          true,
+	"Accept-Language": true,
+}
+
+// newClient :client sending headers of cfg and j with every request of j,
+// cookies are taken from jar of cfg and basic auth per host from netrc of
+// cfg
+func newClient(cfg config, j *job) *http.Client {
+	header := make(http.Header)
+	for k, v := range cfg.header {
+		header[k] = v
+	}
+	for k, v := range j.header {
+		header[k] = v
+	}
+
+	if len(header) == 0 && cfg.jar == nil && cfg.netrc == nil {
+		return &http.Client{Transport: cfg.transport}
+	}
+
+	// only urls given for j are trusted with credentials
+	trusted := make(map[string]bool)
+	for _, s := range append([]string{j.src}, j.mirrors...) {
+		if u, err := url.Parse(s); err == nil {
+			trusted[origin(u)] = true
+		}
+	}
+
+	return &http.Client{
+		Transport: &headerTransport{base: cfg.transport, header: header, trusted: trusted, netrc: cfg.netrc},
+		Jar:       cfg.jar,
+	}
+}
+
+// newTransport :transport shared by every download and worker,
+// connections go through proxy of p and use tls config c
+func newTransport(p *proxyConfig, c *tls.Config) *http.Transport {
+	// settings of http.DefaultTransport apart from proxy and tls, and it
+	// speaks HTTP/1.1 only: a custom dialer and tls config turn HTTP/2 off,
+	// which is wanted, every worker gets a connection of its own instead of
+	// a stream sharing one, and -max-conn caps real connections
+	return &http.Transport{
+		Proxy:           p.proxy,
+		TLSClientConfig: c,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// origin :scheme and host of u, credentials never go to another one
+func origin(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// headerTransport :add header to requests before sending them with base,
+// a request to an untrusted origin only gets safe headers; a request to a
+// trusted one without Authorization gets basic auth of its host from netrc
+type headerTransport struct {
+	base    http.RoundTripper
+	header  http.Header
+	trusted map[string]bool
+	netrc   *netrc
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the caller's request
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+len(t.header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+
+	trusted := t.trusted[origin(req.URL)]
+	for k, v := range t.header {
+		if trusted || safeHeaders[k] {
+			r.Header[k] = v
+		}
+	}
+
+	// netrc default would follow a redirect anywhere, and signed urls
+	// reject a second authentication
+	if trusted && r.Header.Get("Authorization") == "" {
+		if l := t.netrc.lookup(req.URL.Hostname()); l != nil {
+			r.SetBasicAuth(l.login, l.password)
+		}
+	}
+	return t.base.RoundTrip(r)
+}
+
+// parseHeader :parse "Name: value"
+func parseHeader(s string) (string, string, error) {
+	kv := strings.SplitN(s, ":", 2)
+	if len(kv) != 2 || len(textproto.TrimString(kv[0])) == 0 {
+		return "", "", errors.Errorf("header must be Name: value, got %q", s)
+	}
+	return textproto.CanonicalMIMEHeaderKey(textproto.TrimString(kv[0])), textproto.TrimString(kv[1]), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedirectCredentials(t *testing.T) {
+	// other :second origin, same host on another port
+	var seen http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+	}))
+	defer other.Close()
+
+	var first http.Header
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first = r.Header
+		http.Redirect(w, r, other.URL+"/f.bin", http.StatusFound)
+	}))
+	defer src.Close()
+
+	n, err := parseNetrc(strings.NewReader("machine 127.0.0.1 login alice password s3cret\ndefault login anon password guest\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make(http.Header)
+	header.Set("X-Api-Key", "key")
+	header.Set("User-Agent", "godownloader-test")
+
+	tests := []struct {
+		name    string
+		auth    string
+		mirrors []string
+		// trusted :other origin gets credentials too
+		trusted bool
+	}{
+		{"bearer", "Bearer token", nil, false},
+		{"netrc", "", nil, false},
+		{"mirror", "Bearer token", []string{other.URL + "/f.bin"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config{header: make(http.Header), netrc: n, transport: http.DefaultTransport}
+			for k, v := range header {
+				cfg.header[k] = v
+			}
+			if tt.auth != "" {
+				cfg.header.Set("Authorization", tt.auth)
+			}
+			first, seen = nil, nil
+
+			j := &job{src: src.URL + "/f.bin", mirrors: tt.mirrors}
+			resp, err := newClient(cfg, j).Get(j.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			auth := tt.auth
+			if auth == "" {
+				req, _ := http.NewRequest(http.MethodGet, j.src, nil)
+				req.SetBasicAuth("alice", "s3cret")
+				auth = req.Header.Get("Authorization")
+			}
+			if got := first.Get("Authorization"); got != auth {
+				t.Errorf("source got Authorization %q, want %q", got, auth)
+			}
+			if got := first.Get("X-Api-Key"); got != "key" {
+				t.Errorf("source got X-Api-Key %q, want key", got)
+			}
+
+			if seen == nil {
+				t.Fatal("redirect not followed")
+			}
+			if got := seen.Get("User-Agent"); got != "godownloader-test" {
+				t.Errorf("redirect target got User-Agent %q, want the safe header", got)
+			}
+			if tt.trusted {
+				if got := seen.Get("Authorization"); got != auth {
+					t.Errorf("mirror got Authorization %q, want %q", got, auth)
+				}
+				return
+			}
+			for _, k := range []string{"Authorization", "X-Api-Key"} {
+				if got := seen.Get(k); got != "" {
+					t.Errorf("redirect target got %s %q, want none", k, got)
+				}
+			}
+		})
+	}
+}
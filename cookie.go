@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// httpOnlyPrefix :marks http only cookies in a Netscape cookie file
+const httpOnlyPrefix = "#HttpOnly_"
+
+// loadCookies :cookie jar filled from a Netscape format cookie file, the
+// jar sends each cookie only to its own domain
+func loadCookies(name string) (http.CookieJar, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open cookie file")
+	}
+	defer f.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		if httpOnly {
+			line = line[len(httpOnlyPrefix):]
+		}
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// domain, include subdomains, path, secure, expires, name, value
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, errors.Errorf("%s:%d: cookie must have 7 tab separated fields", name, n)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("%s:%d: invalid expiry %q", name, n, fields[4])
+		}
+
+		c := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		// 0 is a session cookie
+		if expires != 0 {
+			c.Expires = time.Unix(expires, 0)
+			if c.Expires.Before(now) {
+				continue
+			}
+		}
+
+		host := strings.TrimPrefix(fields[0], ".")
+		if strings.EqualFold(fields[1], "TRUE") {
+			c.Domain = host
+		}
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: c.Path}, []*http.Cookie{c})
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read cookie file")
+	}
+	return jar, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"godownloader/httpfile"
+	"os"
+	"sync"
+	"time"
+
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// display :progress output of downloads
+type display interface {
+	// observe :progress observer for the next run of h
+	observe(j *job, h *httpfile.HTTPFile) func(httpfile.Event)
+	// stop :run of h returned err
+	stop(j *job, h *httpfile.HTTPFile, err error)
+	// printf :status message about j
+	printf(j *job, format string, a ...interface{})
+}
+
+// barDisplay :one progress bar per run, used for a single download
+type barDisplay struct {
+	bar *pb.ProgressBar
+}
+
+func (d *barDisplay) observe(j *job, h *httpfile.HTTPFile) func(httpfile.Event) {
+	bar := pb.New64(h.Length)
+	bar.SetUnits(pb.U_BYTES)
+	bar.SetRefreshRate(time.Second)
+	bar.ShowSpeed = true
+	if h.Length < 0 {
+		// unknown length, only bytes received and speed could be shown
+		bar.Total = 0
+		bar.ShowBar = false
+	}
+	d.bar = nil
+
+	return func(e httpfile.Event) {
+		if d.bar == nil {
+			// bytes reused from cache do not count into speed
+			bar.Set64(e.Resumed)
+			bar.Start()
+			d.bar = bar
+		}
+		if e.Retries > 0 {
+			bar.Prefix(fmt.Sprintf("retries %d ", e.Retries))
+		}
+		bar.Set64(e.Bytes)
+	}
+}
+
+func (d *barDisplay) stop(j *job, h *httpfile.HTTPFile, err error) {
+	if d.bar != nil {
+		d.bar.Finish()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "download failed, %d retries\n", h.Retries())
+		return
+	}
+	fmt.Fprintf(os.Stdout, "download finished, %d retries\n", h.Retries())
+}
+
+func (d *barDisplay) printf(j *job, format string, a ...interface{}) {
+	fmt.Fprintf(os.Stdout, format+"\n", a...)
+}
+
+// batchDisplay :one bar adding up bytes of every file in a batch
+type batchDisplay struct {
+	mu     sync.Mutex
+	bar    *pb.ProgressBar
+	files  int
+	done   int
+	bytes  map[*job]int64
+	length map[*job]int64
+}
+
+func newBatchDisplay(files int) *batchDisplay {
+	bar := pb.New64(0)
+	bar.SetUnits(pb.U_BYTES)
+	bar.SetRefreshRate(time.Second)
+	bar.ShowSpeed = true
+	bar.Prefix(fmt.Sprintf("0/%d files ", files))
+
+	return &batchDisplay{
+		bar:    bar,
+		files:  files,
+		bytes:  make(map[*job]int64),
+		length: make(map[*job]int64),
+	}
+}
+
+func (d *batchDisplay) start() {
+	d.bar.Start()
+}
+
+func (d *batchDisplay) observe(j *job, h *httpfile.HTTPFile) func(httpfile.Event) {
+	return func(e httpfile.Event) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		d.bytes[j] = e.Bytes
+		d.length[j] = e.Length
+		d.update()
+	}
+}
+
+func (d *batchDisplay) stop(j *job, h *httpfile.HTTPFile, err error) {}
+
+func (d *batchDisplay) printf(j *job, format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "\r%s: %s\n", j.name(), fmt.Sprintf(format, a...))
+}
+
+// finish :j is saved or given up
+func (d *batchDisplay) finish(j *job) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.done++
+	d.bar.Prefix(fmt.Sprintf("%d/%d files ", d.done, d.files))
+}
+
+// update :sum up files, those of unknown length only count their bytes
+func (d *batchDisplay) update() {
+	var bytes, length int64
+	for j, n := range d.bytes {
+		bytes += n
+		if l := d.length[j]; l >= 0 {
+			length += l
+		} else {
+			length += n
+		}
+	}
+	d.bar.SetTotal64(length)
+	d.bar.Set64(bytes)
+}
+
+func (d *batchDisplay) close() {
+	d.bar.Finish()
+}
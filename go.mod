@@ -7,6 +7,6 @@ require (
 	github.com/mattn/go-colorable v0.1.1 // indirect
 	github.com/mattn/go-runewidth v0.0.4 // indirect
 	github.com/pkg/errors v0.8.1
-	golang.org/x/sys v0.0.0-20190416152802-12500544f89f // indirect
+	golang.org/x/sys v0.0.0-20190416152802-12500544f89f
 	gopkg.in/cheggaaa/pb.v1 v1.0.28
 )
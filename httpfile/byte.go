@@ -1,5 +1,11 @@
 package httpfile
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 type ByteSize uint64
 
 const (
@@ -13,5 +19,50 @@ const (
 )
 
 const (
+	// MinChunkSize :chunk size unless a Planner decides otherwise
 	MinChunkSize int64 = int64(1 * MB)
+
+	// bounds of chunk size picked by Planner in auto mode
+	AutoMinChunkSize int64 = int64(256 * KB)
+	AutoMaxChunkSize int64 = int64(64 * MB)
 )
+
+var units = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"EB", EB}, {"PB", PB}, {"TB", TB}, {"GB", GB}, {"MB", MB}, {"KB", KB},
+	{"E", EB}, {"P", PB}, {"T", TB}, {"G", GB}, {"M", MB}, {"K", KB},
+	{"B", B},
+}
+
+// ParseByteSize :parse human size like "512", "8MB", "1.5G" or "4MiB",
+// units are powers of 1024
+func ParseByteSize(s string) (ByteSize, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.Replace(str, "IB", "B", 1)
+
+	unit := B
+	for _, u := range units {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, u.suffix))
+			unit = u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return ByteSize(n * float64(unit)), nil
+}
+
+func (b ByteSize) String() string {
+	for _, u := range units[:6] {
+		if b >= u.size {
+			return strconv.FormatFloat(float64(b)/float64(u.size), 'f', 1, 64) + u.suffix
+		}
+	}
+	return strconv.FormatUint(uint64(b), 10) + "B"
+}
@@ -0,0 +1,276 @@
+package httpfile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CacheEntry :unfinished download found under a cache root
+type CacheEntry struct {
+	// ID :name of its cache dir, or of the file older versions kept a
+	// single stream in
+	ID   string
+	Path string
+
+	// URL, Output, Identity :what cache resume needs to continue it, Output
+	// is empty when it was never recorded
+	URL      string
+	Output   string
+	Identity Identity
+
+	// Size :length of remote file, -1 when unknown; Stored :bytes already
+	// downloaded; Disk :bytes taken on disk, including a direct part file
+	Size   int64
+	Stored int64
+	Disk   int64
+
+	// ModTime :last time it was written to
+	ModTime time.Time
+
+	// Direct :chunks are written into a part file next to output
+	Direct bool
+
+	// Owner :process downloading it right now, nil if none
+	Owner *LockOwner
+
+	// Resumable :false for entries of older versions or without manifest,
+	// they could only be removed
+	Resumable bool
+}
+
+// Percent :share of remote file already downloaded, -1 when size is unknown
+func (e *CacheEntry) Percent() float64 {
+	switch {
+	case e.Size < 0:
+		return -1
+	case e.Size == 0:
+		return 100
+	}
+	return float64(e.Stored) * 100 / float64(e.Size)
+}
+
+// Remove :delete cache dir or file of e and its part file, if any; fail with a
+// LockedError while it is in use
+func (e *CacheEntry) Remove() error {
+	l, _, err := lockEntry(e.Path)
+	if err != nil {
+		return err
+	}
+
+	if st, ok := readControl(e.Path); ok && strings.HasSuffix(st.Part, partSuffix) {
+		err := os.Remove(st.Part)
+		if err != nil && !os.IsNotExist(err) {
+			l.release(false)
+			return errors.Wrapf(err, "could not remove part file: %s", st.Part)
+		}
+	}
+
+	err = os.RemoveAll(e.Path)
+	if err != nil {
+		l.release(false)
+		return errors.Wrapf(err, "could not remove cache dir: %s", e.Path)
+	}
+	return l.release(true)
+}
+
+// ListCache :every entry under root, least recently written first; anything
+// else is left alone, root could be shared with anything
+func ListCache(root string) ([]*CacheEntry, error) {
+	infos, err := ioutil.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "could not read cache dir: %s", root)
+	}
+
+	var entries []*CacheEntry
+	for _, fi := range infos {
+		if !isEntry(root, fi) {
+			continue
+		}
+		if !fi.IsDir() {
+			entries = append(entries, streamEntry(root, fi))
+			continue
+		}
+		e, err := readEntry(filepath.Join(root, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime.Before(entries[j].ModTime)
+	})
+	return entries, nil
+}
+
+// FindCache :entry under root whose ID starts with prefix
+func FindCache(root, prefix string) (*CacheEntry, error) {
+	if len(prefix) == 0 {
+		return nil, errors.New("empty cache id")
+	}
+	entries, err := ListCache(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *CacheEntry
+	for _, e := range entries {
+		if !strings.HasPrefix(e.ID, prefix) {
+			continue
+		}
+		if found != nil {
+			return nil, errors.Errorf("cache id %s is ambiguous", prefix)
+		}
+		found = e
+	}
+	if found == nil {
+		return nil, errors.Errorf("no cache entry %s", prefix)
+	}
+	return found, nil
+}
+
+// PruneCache :remove entries under root not written for olderThan, then the
+// least recently written ones until all of them take at most maxSize bytes;
+// 0 disables either limit, entries in use are kept. Return removed entries
+func PruneCache(root string, olderThan time.Duration, maxSize int64) ([]*CacheEntry, error) {
+	entries, err := ListCache(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.Disk
+	}
+
+	var removed []*CacheEntry
+	for _, e := range entries {
+		expired := olderThan > 0 && time.Since(e.ModTime) > olderThan
+		if !expired && (maxSize <= 0 || total <= maxSize) {
+			continue
+		}
+
+		err := e.Remove()
+		if IsLocked(err) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		total -= e.Disk
+		removed = append(removed, e)
+	}
+	return removed, nil
+}
+
+// readEntry :describe cache dir, whatever state it is in
+func readEntry(dir string) (*CacheEntry, error) {
+	e := &CacheEntry{ID: filepath.Base(dir), Path: dir, Size: -1}
+	e.Owner = lockOwner(dir + lockSuffix)
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read cache dir: %s", dir)
+	}
+	if fi, err := os.Stat(dir); err == nil {
+		e.ModTime = fi.ModTime()
+	}
+	for _, fi := range infos {
+		e.Disk += fi.Size()
+		if fi.ModTime().After(e.ModTime) {
+			e.ModTime = fi.ModTime()
+		}
+		if strings.HasPrefix(fi.Name(), "chunk-") || fi.Name() == "stream" {
+			e.Stored += fi.Size()
+		}
+	}
+
+	// a direct download keeps its bytes in the part file next to output
+	if st, ok := readControl(dir); ok {
+		e.Direct = true
+		for _, d := range st.Done {
+			e.Stored += d[1] - d[0]
+		}
+		if fi, err := os.Stat(st.Part); err == nil {
+			e.Disk += fi.Size()
+		}
+	}
+
+	m, err := loadManifest(dir)
+	if err != nil || m == nil {
+		// unreadable or missing manifest, nothing more to tell
+		return e, nil
+	}
+	e.URL = m.URL
+	e.Size = m.Size
+	e.Output = m.Output
+	e.Identity = m.Identity
+	e.Resumable = m.Version == manifestVersion && m.Key != "" && e.ID == storeName(m.Key)
+	if e.Size >= 0 && e.Stored > e.Size {
+		e.Stored = e.Size
+	}
+	return e, nil
+}
+
+// isEntry :report whether fi under root is a cache entry: a dir named by
+// storeName, or named by number like older versions did, holding a manifest
+// or chunks; their single streams were a file named by number
+func isEntry(root string, fi os.FileInfo) bool {
+	name := fi.Name()
+	if fi.IsDir() && len(name) == len(storeName("")) && strings.Trim(name, "0123456789abcdef") == "" {
+		return true
+	}
+	if _, err := strconv.ParseUint(name, 10, 32); err != nil {
+		return false
+	}
+	if !fi.IsDir() {
+		return fi.Mode().IsRegular()
+	}
+
+	infos, err := ioutil.ReadDir(filepath.Join(root, name))
+	if err != nil {
+		return false
+	}
+	for _, c := range infos {
+		if c.Name() == manifestName || strings.HasPrefix(c.Name(), "chunk-") {
+			return true
+		}
+	}
+	return false
+}
+
+// streamEntry :single stream file of older versions, it could only be
+// removed
+func streamEntry(root string, fi os.FileInfo) *CacheEntry {
+	p := filepath.Join(root, fi.Name())
+	return &CacheEntry{
+		ID:      fi.Name(),
+		Path:    p,
+		Size:    -1,
+		Stored:  fi.Size(),
+		Disk:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Owner:   lockOwner(p + lockSuffix),
+	}
+}
+
+// readControl :progress of a direct download cached in dir, if any
+func readControl(dir string) (partState, bool) {
+	st := partState{}
+	b, err := ioutil.ReadFile(filepath.Join(dir, controlName))
+	if err != nil || json.Unmarshal(b, &st) != nil {
+		return st, false
+	}
+	return st, true
+}
@@ -0,0 +1,68 @@
+package httpfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListCache(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+
+	write := func(name string, n int) {
+		p := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(p), dirMode)
+		if err == nil {
+			err = ioutil.WriteFile(p, []byte(strings.Repeat("x", n)), 0660)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// chunks and single stream of older versions
+	write("3141592653/chunk-0", 10)
+	write("271828/manifest.json", 2)
+	write("1234567", 30)
+	// not ours: root could be shared
+	write("42/notes.txt", 1)
+	write("99999999999", 1)
+	write("readme.txt", 1)
+	write("photos/a.jpg", 1)
+
+	entries, err := ListCache(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+		if e.Resumable {
+			t.Errorf("%s: leftover of older version taken as resumable", e.ID)
+		}
+	}
+	sort.Strings(ids)
+	if got, want := strings.Join(ids, " "), "1234567 271828 3141592653"; got != want {
+		t.Fatalf("listed %s, want %s", got, want)
+	}
+
+	removed, err := PruneCache(root, time.Nanosecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 3 {
+		t.Errorf("pruned %d entries, want 3", len(removed))
+	}
+	left, _ := ioutil.ReadDir(root)
+	var names []string
+	for _, fi := range left {
+		names = append(names, fi.Name())
+	}
+	if got, want := strings.Join(names, " "), "42 99999999999 photos readme.txt"; got != want {
+		t.Errorf("left %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,85 @@
+package httpfile
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Checksum :expected digest of the downloaded file
+type Checksum struct {
+	Algo string
+	Sum  []byte
+}
+
+// ParseChecksum :parse "algo:hex", algo is one of md5, sha1, sha256, sha512
+func ParseChecksum(s string) (*Checksum, error) {
+	i := strings.Index(s, ":")
+	if i == -1 {
+		return nil, fmt.Errorf("invalid checksum %q, format is algo:hex", s)
+	}
+
+	algo := strings.ToLower(s[:i])
+	newHash, ok := hashes[algo]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm: %s", algo)
+	}
+
+	sum, err := hex.DecodeString(s[i+1:])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid checksum %q", s)
+	}
+	if len(sum) != newHash().Size() {
+		return nil, fmt.Errorf("invalid checksum %q, %s digest has %d bytes", s, algo, newHash().Size())
+	}
+
+	return &Checksum{Algo: algo, Sum: sum}, nil
+}
+
+func (c *Checksum) String() string {
+	return c.Algo + ":" + hex.EncodeToString(c.Sum)
+}
+
+func (c *Checksum) newHash() hash.Hash {
+	return hashes[c.Algo]()
+}
+
+// verify :compare digest computed by h with expected one
+func (c *Checksum) verify(h hash.Hash) error {
+	got := h.Sum(nil)
+	if !bytes.Equal(got, c.Sum) {
+		return &ChecksumError{Algo: c.Algo, Want: c.Sum, Got: got}
+	}
+	return nil
+}
+
+// ChecksumError :downloaded file does not match expected checksum
+type ChecksumError struct {
+	Algo      string
+	Want, Got []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: want %x, got %x", e.Algo, e.Want, e.Got)
+}
+
+// IsChecksumMismatch :report whether err means the downloaded file is corrupt
+func IsChecksumMismatch(err error) bool {
+	_, ok := errors.Cause(err).(*ChecksumError)
+	return ok
+}
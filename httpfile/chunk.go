@@ -1,11 +1,16 @@
 package httpfile
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 
 	"github.com/pkg/errors"
 )
@@ -15,42 +20,270 @@ type Range struct {
 }
 
 type chunk struct {
+	id   int
 	r    *Range
 	path string
 	size int64
 	f    io.WriteCloser
+
+	// mu :guard r, size, written and active; range of an active chunk is
+	// shrunk when another worker takes over its tail
+	mu sync.Mutex
+
+	// written :bytes already stored in chunk file
+	written int64
+	active  bool
+
+	// tail :back half taken over from another chunk, not part of the plan
+	tail bool
+
+	// resume :stream of unknown length continues with an open ended range
+	resume bool
+
+	// part :shared output file, chunk is written in place instead of path
+	part *partFile
+
+	// meter :count bytes written by every chunk of a download
+	meter *meter
+}
+
+// offset :where chunk starts in the whole file
+func (c *chunk) offset() int64 {
+	if c.r == nil {
+		return 0
+	}
+	return c.r.start
 }
 
+// Create :open chunk file, drop anything after written bytes
 func (c *chunk) Create() error {
-	f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0660)
+	err := c.create()
+	if err == nil && c.meter != nil {
+		c.f = &countingWriter{w: c.f, m: c.meter}
+	}
+	return err
+}
+
+func (c *chunk) create() error {
+	if c.part != nil {
+		c.f = c.part.writer(c.offset() + c.written)
+		return nil
+	}
+
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE, 0660)
 	if nil != err {
 		return errors.Wrapf(err, "could not create dst file: %s", c.path)
 	}
+
+	err = f.Truncate(c.written)
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "could not truncate dst file: %s", c.path)
+	}
+	_, err = f.Seek(c.written, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "could not seek dst file: %s", c.path)
+	}
+
 	c.f = f
 	return nil
 }
 
+// Close :close chunk file and keep exactly the written bytes
 func (c *chunk) Close() error {
-	return c.f.Close()
+	err := c.f.Close()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c.part != nil && c.r == nil:
+		// stream could have restarted shorter than what was recorded
+		return c.part.commitStream(c.written)
+	case c.part != nil:
+		return c.part.commit(c.offset(), c.offset()+c.written)
+	}
+	return os.Truncate(c.path, c.written)
 }
 
+// Write :copy r into chunk until r ends or chunk is full; chunk could be
+// shrunk meanwhile, so the rest of r is left unread
 func (c *chunk) Write(r io.Reader) (int64, error) {
-	return io.Copy(c.f, r)
+	buf := make([]byte, 32*1024)
+
+	var total int64
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			w, full, err := c.write(buf[:n])
+			total += w
+			if err != nil {
+				return total, err
+			}
+			if full {
+				return total, nil
+			}
+		}
+		if rerr == io.EOF {
+			return total, nil
+		}
+		if rerr != nil {
+			return total, rerr
+		}
+	}
+}
+
+// write :store b up to the current end of chunk, report whether chunk is full
+func (c *chunk) write(b []byte) (int64, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size >= 0 && int64(len(b)) > c.size-c.written {
+		b = b[:c.size-c.written]
+	}
+	n, err := c.f.Write(b)
+	c.written += int64(n)
+	return int64(n), c.size >= 0 && c.written >= c.size, err
 }
 
+// isDone :inspect chunk file and record how many bytes could be reused
 func (c *chunk) isDone() (bool, error) {
+	stored, err := c.stored()
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.written = 0
+
+	if c.size >= 0 && stored == c.size {
+		c.written = c.size
+		return true, nil
+	}
+
+	// without range we could not resume, oversized file is inconsistent;
+	// both start over, file will be truncated on Create
+	if (c.r == nil && !c.resume) || (c.size >= 0 && stored > c.size) {
+		if c.part != nil && c.r == nil {
+			// progress of the stream is thrown away, so are its bytes
+			return false, c.part.commitStream(0)
+		}
+		return false, nil
+	}
+
+	c.written = stored
+	return false, nil
+}
+
+// stored :bytes found in chunk file or recorded for chunk in part file
+func (c *chunk) stored() (int64, error) {
+	if c.part != nil {
+		if c.size < 0 {
+			if !c.resume {
+				return 0, nil
+			}
+			return c.part.stored(0, math.MaxInt64), nil
+		}
+		return c.part.stored(c.offset(), c.offset()+c.size), nil
+	}
+
 	f, err := os.Stat(c.path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return false, nil
+			return 0, nil
+		}
+
+		return 0, errors.Wrapf(err, "could not stat file: %s", c.path)
+	}
+	return f.Size(), nil
+}
+
+// progress :bytes stored and size of chunk
+func (c *chunk) progress() (int64, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written, c.size
+}
+
+// activate :mark chunk in progress and return the range to request
+func (c *chunk) activate() Range {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.active = true
+	if c.r == nil {
+		if !c.resume {
+			// whole body is sent again, nothing written before could be kept
+			c.written = 0
 		}
+		return Range{c.written, c.size - 1}
+	}
+	return Range{c.r.start + c.written, c.r.end}
+}
+
+// restart :drop bytes written so far, body starts from the beginning
+func (c *chunk) restart() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.meter != nil {
+		c.meter.add(-c.written)
+	}
+	c.written = 0
+}
+
+func (c *chunk) deactivate() {
+	c.mu.Lock()
+	c.active = false
+	c.mu.Unlock()
+}
+
+// left :bytes an active chunk still misses, 0 when it could not be split
+func (c *chunk) left() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.active || c.r == nil {
+		return 0
+	}
+	return c.size - c.written
+}
+
+// split :shrink active chunk to the front half of its missing range and
+// return a chunk for the back half, nil when the rest is too small to share
+func (c *chunk) split(id int, minSize int64) *chunk {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		return false, errors.Wrapf(err, "could not stat file: %s", c.path)
+	if !c.active || c.r == nil {
+		return nil
 	}
-	return f.Size() == c.size, nil
+	pos := c.r.start + c.written
+	left := c.r.end - pos + 1
+	if left < 2*minSize {
+		return nil
+	}
+
+	mid := pos + left/2
+	t := &chunk{
+		id:    id,
+		r:     &Range{mid, c.r.end},
+		path:  fmt.Sprintf("%s-%d", c.path, mid),
+		size:  c.r.end - mid + 1,
+		tail:  true,
+		part:  c.part,
+		meter: c.meter,
+	}
+
+	c.r.end = mid - 1
+	c.size = c.r.end - c.r.start + 1
+	return t
 }
 
-func newChunks(path string, size int64) []*chunk {
+func newChunks(path string, size int64, chunkSize int64) []*chunk {
 	chunks := make([]*chunk, 0)
 
 	chuckID := 0
@@ -58,49 +291,244 @@ func newChunks(path string, size int64) []*chunk {
 	var end int64
 	var receiveSize int64
 
-	for start, chuckID = 0, 0; start < size; start, chuckID = start+MinChunkSize, chuckID+1 {
+	for start, chuckID = 0, 0; start < size; start, chuckID = start+chunkSize, chuckID+1 {
 
 		chunkFilename := fmt.Sprintf("chunk-%d", chuckID)
 		chunkPath := filepath.Join(path, chunkFilename)
-		if (start + MinChunkSize) < size {
-			receiveSize = MinChunkSize
+		if (start + chunkSize) < size {
+			receiveSize = chunkSize
 
 		} else {
 			receiveSize = size - start
 		}
 		end = start + receiveSize - 1
-		c := &chunk{path: chunkPath, size: receiveSize, r: &Range{start, end}}
+		c := &chunk{id: chuckID, path: chunkPath, size: receiveSize, r: &Range{start, end}}
 		chunks = append(chunks, c)
 	}
 	return chunks
 }
 
-func downloadChunk(client *http.Client, url string, c *chunk) error {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// fetch :how chunks of one remote file are requested
+type fetch struct {
+	client *http.Client
+	url    string
+
+	// validator :sent with If-Range, so a changed remote file could not be
+	// mixed into the chunk
+	validator string
+
+	// limiters :caps shared with other connections
+	limiters []*Limiter
+	// connRate :cap of a single connection, 0 is unlimited
+	connRate int64
+
+	// pool :connection slots shared with other downloads
+	pool *Pool
+}
+
+// downloadChunk :fetch missing part of chunk
+func downloadChunk(ctx context.Context, f *fetch, c *chunk) error {
+	want := c.activate()
+	defer c.deactivate()
+
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
 	if err != nil {
 		return errors.Wrap(err, "could not create http request")
 	}
+	req = req.WithContext(ctx)
 
-	if c.r != nil {
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", c.r.start, c.r.end))
+	err = f.pool.acquire(ctx, req.URL.Host)
+	if err != nil {
+		return err
 	}
+	defer f.pool.release(req.URL.Host)
 
-	resp, err := client.Do(req)
+	switch {
+	case c.r != nil:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", want.start, want.end))
+	case want.start > 0:
+		// resume stream of unknown length
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", want.start))
+	}
+	if f.validator != "" && req.Header.Get("Range") != "" {
+		req.Header.Set("If-Range", f.validator)
+	}
+
+	resp, err := f.client.Do(req)
 	if nil != err {
 		return errors.Wrap(err, "could not get src file")
 	}
 	defer resp.Body.Close()
 
+	err = checkResponse(c, want, resp, f.validator)
+	if err == errStreamDone {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if c.r == nil && want.start > 0 && resp.StatusCode == http.StatusOK {
+		// server sent the whole stream again
+		c.restart()
+	}
+
 	err = c.Create()
 	if nil != err {
 		return errors.Wrap(err, "could not create dst file")
 	}
-	defer c.Close()
 
-	_, err = c.Write(resp.Body)
+	limiters := f.limiters
+	if f.connRate > 0 {
+		limiters = append(limiters, NewLimiter(f.connRate))
+	}
+	err = c.copyBody(want, newRateReader(ctx, resp.Body, limiters...))
+	c.deactivate()
+	if err != nil {
+		// keep only the bytes which could be trusted
+		c.Close()
+		return err
+	}
+
+	return c.Close()
+}
+
+// copyBody :copy requested range from body into chunk file, bytes received
+// before a failure are kept for the next resume
+func (c *chunk) copyBody(want Range, body io.Reader) error {
+	n, err := c.Write(body)
 	if err != nil {
 		return errors.Wrap(err, "could not copy download content into dst file")
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size < 0 {
+		return nil
+	}
+	if c.written != c.size {
+		// connection closed early, worth another attempt
+		return errors.Wrapf(io.ErrUnexpectedEOF, "chunk-%d bytes=%d-%d: body too short: got %d bytes, want %d",
+			c.id, want.start, want.end, n, n+c.size-c.written)
+	}
+
+	// anything left in body means the server sent more than requested,
+	// so the received tail could not be trusted; a shrunk chunk stops early
+	if c.r != nil && c.r.end != want.end {
+		return nil
+	}
+	extra, _ := io.CopyN(ioutil.Discard, body, 1)
+	if extra > 0 {
+		c.written -= n
+		if c.meter != nil {
+			c.meter.add(-n)
+		}
+		return c.rangeError(want, http.StatusPartialContent, "", fmt.Sprintf("body too long: want %d bytes", n))
+	}
 	return nil
 }
+
+func (c *chunk) rangeError(want Range, status int, contentRange, reason string) *RangeError {
+	e := &RangeError{Chunk: c.id, Status: status, ContentRange: contentRange, Reason: reason}
+	if c.r != nil {
+		e.Start, e.End = want.start, want.end
+	}
+	return e
+}
+
+// checkResponse :make sure server answered with the requested range
+func checkResponse(c *chunk, want Range, resp *http.Response, validator string) error {
+	contentRange := resp.Header.Get("Content-Range")
+
+	if c.r == nil {
+		return checkStream(c, want, resp, validator)
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return newStatusError(c, resp)
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		if resp.StatusCode == http.StatusOK {
+			// If-Range did not match: whole body is a different remote file
+			if changed(resp, validator) {
+				return errors.Wrapf(ErrRemoteChanged, "chunk-%d", c.id)
+			}
+			return c.rangeError(want, resp.StatusCode, contentRange, "server ignored range request")
+		}
+		return c.rangeError(want, resp.StatusCode, contentRange, "unexpected status")
+	}
+
+	start, end, _, err := parseContentRange(contentRange)
+	if err != nil {
+		return c.rangeError(want, resp.StatusCode, contentRange, err.Error())
+	}
+	if start != want.start || end != want.end {
+		return c.rangeError(want, resp.StatusCode, contentRange, "content range mismatch")
+	}
+	if size := want.end - want.start + 1; resp.ContentLength >= 0 && resp.ContentLength != size {
+		return c.rangeError(want, resp.StatusCode, contentRange,
+			fmt.Sprintf("content length mismatch: got %d, want %d", resp.ContentLength, size))
+	}
+	return nil
+}
+
+// errStreamDone :resumed stream has nothing left to send
+var errStreamDone = errors.New("stream already complete")
+
+// checkStream :make sure server answered a stream request as expected; a
+// resumed stream gets its missing tail, or the whole body again when the
+// server ignored range, or nothing when it was already complete
+func checkStream(c *chunk, want Range, resp *http.Response, validator string) error {
+	contentRange := resp.Header.Get("Content-Range")
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if want.start > 0 && changed(resp, validator) {
+			return errors.Wrapf(ErrRemoteChanged, "chunk-%d", c.id)
+		}
+		return nil
+	case resp.StatusCode == http.StatusPartialContent && want.start > 0:
+		start, _, _, err := parseContentRange(contentRange)
+		if err != nil {
+			return c.rangeError(want, resp.StatusCode, contentRange, err.Error())
+		}
+		if start != want.start {
+			return c.rangeError(want, resp.StatusCode, contentRange, "content range mismatch")
+		}
+		return nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && want.start > 0:
+		var total int64
+		_, err := fmt.Sscanf(contentRange, "bytes */%d", &total)
+		if err == nil && total == want.start {
+			return errStreamDone
+		}
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return newStatusError(c, resp)
+	}
+	return c.rangeError(want, resp.StatusCode, contentRange, "unexpected status")
+}
+
+// changed :report whether resp belongs to another version than validator
+func changed(resp *http.Response, validator string) bool {
+	return validator != "" && resp.Header.Get("ETag") != validator && resp.Header.Get("Last-Modified") != validator
+}
+
+// parseContentRange :parse "bytes start-end/total" header, total is -1
+// when given as *
+func parseContentRange(s string) (start, end, total int64, err error) {
+	var size string
+	_, err = fmt.Sscanf(s, "bytes %d-%d/%s", &start, &end, &size)
+	if err != nil || start < 0 || end < start {
+		return 0, 0, 0, fmt.Errorf("invalid content range")
+	}
+	if size == "*" {
+		return start, end, -1, nil
+	}
+	total, err = strconv.ParseInt(size, 10, 64)
+	if err != nil || total <= end {
+		return 0, 0, 0, fmt.Errorf("invalid content range")
+	}
+	return start, end, total, nil
+}
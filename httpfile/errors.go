@@ -0,0 +1,66 @@
+package httpfile
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRemoteChanged :remote file is not the one cached chunks were downloaded from
+var ErrRemoteChanged = errors.New("remote file changed")
+
+// ErrOutputExists :SaveTo would replace an existing file against NoClobber
+var ErrOutputExists = errors.New("output file already exists")
+
+// RangeError :describe a chunk response which does not match the requested range
+type RangeError struct {
+	Chunk        int
+	Start, End   int64
+	Status       int
+	ContentRange string
+	Reason       string
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("chunk-%d bytes=%d-%d: %s (status: %d, content-range: %q)",
+		e.Chunk, e.Start, e.End, e.Reason, e.Status, e.ContentRange)
+}
+
+// Unsupported :server answered the range request with the whole body
+func (e *RangeError) Unsupported() bool {
+	return e.Status == http.StatusOK
+}
+
+// IsRangeNotSupported :report whether err means the server ignores range requests
+func IsRangeNotSupported(err error) bool {
+	e, ok := errors.Cause(err).(*RangeError)
+	return ok && e.Unsupported()
+}
+
+// IsRemoteChanged :report whether err means the remote file changed during download
+func IsRemoteChanged(err error) bool {
+	return errors.Cause(err) == ErrRemoteChanged
+}
+
+// IsOutputExists :report whether err means output file was kept because it exists
+func IsOutputExists(err error) bool {
+	return errors.Cause(err) == ErrOutputExists
+}
+
+// DownloadError :chunks failed at the same time, first one is the cause
+type DownloadError []error
+
+func (e DownloadError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Cause :first failure, used by errors.Cause
+func (e DownloadError) Cause() error {
+	return e[0]
+}
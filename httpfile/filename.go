@@ -0,0 +1,73 @@
+package httpfile
+
+import (
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// defaultFilename :base name when remote file does not tell one
+const defaultFilename = "download"
+
+// filename :name to save remote file as; Content-Disposition wins, then
+// last segment of the url after redirects, then of the requested url, else
+// a name with an extension of Content-Type
+func filename(r *remote, rawurl string) string {
+	if r.disposition != "" {
+		// filename* of RFC 5987 is decoded and preferred by ParseMediaType
+		_, params, err := mime.ParseMediaType(r.disposition)
+		if err == nil {
+			if name := sanitizeFilename(params["filename"]); name != "" {
+				return name
+			}
+		}
+	}
+
+	for _, s := range []string{r.final, rawurl} {
+		u, err := url.Parse(s)
+		if err != nil {
+			continue
+		}
+		// Path is already percent decoded, query is left out
+		if strings.HasSuffix(u.Path, "/") {
+			continue
+		}
+		if name := sanitizeFilename(path.Base(u.Path)); name != "" {
+			return name
+		}
+	}
+
+	if r.contentType != "" {
+		t, _, err := mime.ParseMediaType(r.contentType)
+		if err == nil {
+			exts, _ := mime.ExtensionsByType(t)
+			if len(exts) > 0 {
+				return defaultFilename + exts[0]
+			}
+		}
+	}
+	return defaultFilename
+}
+
+// sanitizeFilename :s reduced to a plain name which stays in the output
+// directory: anything up to the last path separator and control characters
+// are dropped
+func sanitizeFilename(s string) string {
+	if i := strings.LastIndexAny(s, `/\`); i >= 0 {
+		s = s[i+1:]
+	}
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+
+	s = strings.TrimSpace(s)
+	if s == "." || s == ".." {
+		return ""
+	}
+	return s
+}
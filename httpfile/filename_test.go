@@ -0,0 +1,55 @@
+package httpfile
+
+import (
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{`..\..\windows\system.ini`, "system.ini"},
+		{"/etc/", ""},
+		{"..", ""},
+		{".", ""},
+		{"a/..", ""},
+		{" .. ", ""},
+		{"\x1b[31mred\x1b[0m.txt", "[31mred[0m.txt"},
+		{"line\nbreak\r.txt", "linebreak.txt"},
+		{"nul\x00.bin", "nul.bin"},
+		{"\t\n", ""},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.in); got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		r    remote
+		url  string
+		want string
+	}{
+		{"disposition", remote{disposition: `attachment; filename="a.iso"`}, "http://h/x", "a.iso"},
+		{"traversal", remote{disposition: `attachment; filename="../../.bashrc"`}, "http://h/x", ".bashrc"},
+		{"encoded traversal", remote{disposition: `attachment; filename*=UTF-8''..%2F..%2Fetc%2Fcron.d%2Fjob`}, "http://h/x", "job"},
+		{"encoded wins", remote{disposition: `attachment; filename="plain.txt"; filename*=UTF-8''%E2%82%AC.txt`}, "http://h/x", "€.txt"},
+		{"encoded control", remote{disposition: `attachment; filename*=UTF-8''a%0D%0Ab%07.txt`}, "http://h/x", "ab.txt"},
+		{"only dots", remote{disposition: `attachment; filename=".."`}, "http://h/dir/f.bin", "f.bin"},
+		{"broken disposition", remote{disposition: `attachment; filename="unclosed`}, "http://h/f.bin", "f.bin"},
+		{"redirected", remote{final: "http://h/files/report%20final.pdf?sig=abc"}, "http://h/dl", "report final.pdf"},
+		{"encoded slash in url", remote{}, "http://h/a%2F..%2F..%2Fx.bin", "x.bin"},
+		{"dir url", remote{contentType: "application/json"}, "http://h/dir/", "download.json"},
+		{"nothing", remote{}, "http://h/", "download"},
+	}
+	for _, tt := range tests {
+		if got := filename(&tt.r, tt.url); got != tt.want {
+			t.Errorf("%s: filename = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,11 +1,16 @@
 package httpfile
 
 import (
+	"context"
 	"fmt"
-	"hash/fnv"
+	"hash"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -21,137 +26,655 @@ type HTTPFile struct {
 	Size   int
 	Range  bool
 
+	// Length :size of remote file in bytes, -1 when unknown
+	Length int64
+
+	// RemoteChanged :cached chunks were dropped because remote file changed
+	RemoteChanged bool
+	// StaleLock :owner of a lock left behind by a crashed run, nil if none
+	StaleLock *LockOwner
+
+	// Filename :name suggested by server or url, safe to use as base name
+	Filename string
+
 	store  string
+	meta   *manifest
 	chunks []*chunk
 	worker int
+
+	checksum *Checksum
+	part     *partFile
+	retry    RetryPolicy
+	retries  int32
+	observer *observer
+	meter    *meter
+
+	// limit :cap of this download, shared :cap shared with other downloads,
+	// conn :rate every connection gets its own limiter with
+	limit  *Limiter
+	shared *Limiter
+	conn   *Limiter
+	pool   *Pool
+
+	sources *sourceSet
+
+	// openRange :server answers range requests, so a stream of unknown
+	// length could be resumed
+	openRange bool
+
+	overwrite OverwritePolicy
+	sync      bool
+
+	// resumed :cached chunks are reused, their layout must be kept
+	resumed bool
+
+	// lock :hold of cache dir against other processes
+	lock *entryLock
 }
 
-func NewHTTPFile(c *http.Client, url string, storeRoot string) (*HTTPFile, error) {
-	res, err := c.Head(url)
+// NewHTTPFile :probe url and open its cache dir under storeRoot, cached
+// chunks are found again by id
+func NewHTTPFile(c *http.Client, url string, storeRoot string, id Identity) (*HTTPFile, error) {
+	r, err := probe(c, url)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not get url")
+		return nil, err
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("could not get resource on url: %s", url)
+	key, err := id.key(url, r)
+	if err != nil {
+		return nil, err
 	}
+	storePath := filepath.Join(storeRoot, storeName(key))
 
-	content, ok := res.Header["Accept-Ranges"]
-	var isAcceptRange bool
-	if ok && len(content) > 0 && content[0] != "none" {
-		isAcceptRange = true
+	meta := &manifest{
+		Version:      manifestVersion,
+		Key:          key,
+		URL:          url,
+		Size:         r.length,
+		ChunkSize:    MinChunkSize,
+		Range:        r.rangeOK,
+		ETag:         r.etag,
+		LastModified: r.lastModified,
+		Identity:     id,
 	}
-
-	var (
-		hashID    uint32
-		storePath string
-	)
-
-	hashID = hash(url)
-	storePath = fmt.Sprintf("%s/%d", storeRoot, hashID)
-
-	var chunks []*chunk
-	if isAcceptRange {
-		// if more than one chunk, create dir then create chunks
-		err = createDir(storePath)
-		if err != nil {
-			return nil, errors.Wrap(err, "could not create cache dir")
-		}
-		chunks = newChunks(storePath, res.ContentLength)
-	} else {
-		// if only one chunk, create single file chunk instead
-		chunks = []*chunk{&chunk{path: storePath, size: res.ContentLength}}
+	// another process downloading the same entry would mix its writes in
+	lock, stale, err := lockEntry(storePath)
+	if err != nil {
+		return nil, err
+	}
+	resumed, changed, err := openStore(storePath, meta)
+	if err != nil {
+		lock.release(false)
+		return nil, errors.Wrap(err, "could not open cache dir")
 	}
 
-	return &HTTPFile{
+	h := &HTTPFile{
 		Client: c,
 		URL:    url,
-		chunks: chunks,
-		Size:   len(chunks),
 		worker: 1,
 		store:  storePath,
-		Range:  isAcceptRange,
-	}, nil
+		meta:   meta,
+		Range:  r.rangeOK,
+		Length: r.length,
+		retry:  DefaultRetryPolicy,
+		limit:  NewLimiter(0),
+		conn:   NewLimiter(0),
+
+		RemoteChanged: changed,
+		StaleLock:     stale,
+		lock:          lock,
+		Filename:      filename(r, url),
+		resumed:       resumed,
+		openRange:     r.openRange,
+	}
+	h.sources = &sourceSet{}
+	h.sources.add(&source{url: url, validator: meta.ifRange()})
+	h.plan()
+	return h, nil
+}
+
+// AddMirror :spread chunks over url too; it must serve the same file, with
+// the same length and, when both tell, the same ETag. A mirror which keeps
+// failing during Run is dropped as long as another source is left
+func (h *HTTPFile) AddMirror(url string) error {
+	r, err := probe(h.Client, url)
+	if err != nil {
+		return errors.Wrapf(err, "mirror %s", url)
+	}
+
+	if !h.Range || !r.rangeOK {
+		return fmt.Errorf("mirror %s: range request not supported", url)
+	}
+	if h.Length < 0 || r.length != h.Length {
+		return fmt.Errorf("mirror %s: size %d does not match %d", url, r.length, h.Length)
+	}
+	if r.etag != "" && h.meta.ETag != "" && r.etag != h.meta.ETag {
+		return fmt.Errorf("mirror %s: etag %s does not match %s", url, r.etag, h.meta.ETag)
+	}
+
+	m := &manifest{ETag: r.etag, LastModified: r.lastModified}
+	h.sources.add(&source{url: url, validator: m.ifRange()})
+	return nil
+}
+
+// Sources :urls chunks are downloaded from, mirrors dropped by Run are left
+// out
+func (h *HTTPFile) Sources() []string {
+	return h.sources.urls()
+}
+
+// plan :split remote file into chunks according to manifest
+func (h *HTTPFile) plan() {
+	switch {
+	case h.meta.Size == 0:
+		// nothing to download, SaveTo creates an empty file
+		h.chunks = nil
+	case h.meta.Range:
+		h.chunks = newChunks(h.store, h.meta.Size, h.meta.ChunkSize)
+	default:
+		// if only one chunk, create single file chunk instead
+		h.chunks = singleChunk(h.store, h.meta.Size)
+		// without a validator a resumed stream could mix two versions
+		if h.meta.Size < 0 {
+			h.chunks[0].resume = h.openRange && h.meta.ifRange() != ""
+		}
+	}
+	h.Size = len(h.chunks)
+
+	for _, c := range h.chunks {
+		c.part = h.part
+	}
+}
+
+// SetOutput :record dst in cache, so cache resume knows where to save
+func (h *HTTPFile) SetOutput(dst string) error {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return errors.Wrapf(err, "could not resolve output path: %s", dst)
+	}
+	if dst == h.meta.Output {
+		return nil
+	}
+
+	h.meta.Output = dst
+	return h.meta.save(h.store)
+}
+
+// SetDirect :write chunks in place into a preallocated part file next to
+// dst instead of chunk files, SaveTo then only renames it to dst
+func (h *HTTPFile) SetDirect(dst string) error {
+	if h.part != nil {
+		h.part.f.Close()
+	}
+
+	part, err := openPart(dst, h.store, h.meta.Size)
+	if err != nil {
+		return err
+	}
+
+	h.part = part
+	for _, c := range h.chunks {
+		c.part = part
+	}
+	return nil
 }
 
-// Download :download chunks
-func (h *HTTPFile) Download() (chan struct{}, chan error) {
-	errs := make(chan error)
-	finish := make(chan struct{})
+// Run :download all chunks, block until they are done, ctx is cancelled or
+// a chunk failed; once no chunk is queued, an idle worker takes over the
+// back half of the largest active chunk. Every worker and request is
+// stopped before Run returns, so cached chunks stay resumable
+func (h *HTTPFile) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// back halves taken over before are cached on their own
+	if h.Range {
+		chunks, err := restoreTails(h.chunks, h.store, h.part)
+		if err != nil {
+			return err
+		}
+		h.chunks = chunks
+	}
+
+	// count bytes reused from cache, so progress starts where it stopped
+	h.meter = &meter{}
+	var resumed int64
+	for _, c := range h.chunks {
+		c.meter = h.meter
+		_, err := c.isDone()
+		if err != nil {
+			return err
+		}
+		resumed += c.written
+	}
+	h.meter.add(resumed)
 
-	chunks := make(chan *chunk)
+	s := newScheduler(&h.chunks, h.Range)
+	workers := newWorkers(h.worker)
+
+	var (
+		mu       sync.Mutex
+		failures []error
+		finished int
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		// errors after cancellation are caused by it, not worth reporting
+		if ctx.Err() == nil {
+			failures = append(failures, err)
+		}
+		cancel()
+	}
+	event := func() Event {
+		mu.Lock()
+		defer mu.Unlock()
+
+		e := Event{
+			Bytes:   h.meter.total(),
+			Length:  h.Length,
+			Resumed: resumed,
+			Speed:   h.meter.rate(),
+			Chunks:  finished,
+			Total:   h.Size,
+			Retries: h.Retries(),
+			Workers: make([]WorkerState, len(workers)),
+		}
+		for i, w := range workers {
+			e.Workers[i] = w.snapshot()
+		}
+		return e
+	}
+
+	// report progress until workers stop
+	stop := make(chan struct{})
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		t := time.NewTicker(progressInterval)
+		defer t.Stop()
+		for {
+			h.observer.notify(event())
+			select {
+			case <-t.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
 
 	// worker: consumer
-	for i := 0; i < h.worker; i++ {
-		go func() {
-			for c := range chunks {
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			defer w.set(WorkerDone, nil)
+
+			for c := s.next(); c != nil && ctx.Err() == nil; c = s.next() {
 				done, err := c.isDone()
 				if err != nil {
-					errs <- err
+					fail(err)
 					return
 				}
 
 				if !done {
-					err := downloadChunk(h.Client, h.URL, c)
+					err := h.downloadChunk(ctx, c, w)
 					if err != nil {
-						errs <- err
+						fail(err)
 						return
 					}
 				}
+				w.set(WorkerIdle, nil)
 
-				finish <- struct{}{}
+				if !c.tail {
+					mu.Lock()
+					finished++
+					mu.Unlock()
+				}
 			}
-		}()
+		}(w)
 	}
+	wg.Wait()
 
-	// producer
-	go func() {
-		for _, c := range h.chunks {
-			chunks <- c
+	close(stop)
+	<-reported
+	e := event()
+	e.Done = true
+	h.observer.notify(e)
+
+	switch {
+	case len(failures) == 1:
+		return failures[0]
+	case len(failures) > 1:
+		return DownloadError(failures)
+	}
+	return ctx.Err()
+}
 
+// downloadChunk :download chunk, retry transient failures with backoff;
+// every attempt continues from the bytes kept by the previous one. An
+// attempt failed by a source which then got dropped is repeated at once on
+// another source and does not count
+func (h *HTTPFile) downloadChunk(ctx context.Context, c *chunk, w *worker) error {
+	for attempt := 1; ; attempt++ {
+		w.set(WorkerDownloading, c)
+		src := h.sources.pick()
+		before, _ := c.progress()
+		start := time.Now()
+		err := downloadChunk(ctx, h.fetch(src), c)
+		if ctx.Err() != nil {
+			return err
+		}
+		if err != nil && !isSourceError(err) {
+			// another source would fail the same way
+			return err
 		}
-		close(chunks)
-	}()
 
-	return finish, errs
+		after, _ := c.progress()
+		dropped := h.sources.done(src, after-before, time.Since(start), err)
+		if err == nil {
+			return nil
+		}
+		if dropped {
+			atomic.AddInt32(&h.retries, 1)
+			w.retried()
+			attempt--
+			continue
+		}
+		if attempt >= h.retry.MaxAttempts || !IsRetryable(err) {
+			return err
+		}
+
+		atomic.AddInt32(&h.retries, 1)
+		w.retried()
+		select {
+		case <-time.After(h.retry.delay(attempt, err)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// fetch :request settings of chunks downloaded from src
+func (h *HTTPFile) fetch(src *source) *fetch {
+	return &fetch{
+		client:    h.Client,
+		url:       src.url,
+		validator: src.validator,
+		limiters:  []*Limiter{h.limit, h.shared},
+		connRate:  h.conn.Rate(),
+		pool:      h.pool,
+	}
+}
+
+// SetPool :take chunk connections from p shared with other downloads, set
+// before Run
+func (h *HTTPFile) SetPool(p *Pool) {
+	h.pool = p
+}
+
+// SetRateLimit :cap this download at rate bytes per second, 0 is
+// unlimited; could be changed while Run is active
+func (h *HTTPFile) SetRateLimit(rate int64) {
+	h.limit.SetRate(rate)
+}
+
+// SetConnRateLimit :cap every connection at rate bytes per second, 0 is
+// unlimited; applies to requests started afterwards
+func (h *HTTPFile) SetConnRateLimit(rate int64) {
+	h.conn.SetRate(rate)
 }
 
-// SaveTo :merge chunks and save to dst
-func (h *HTTPFile) SaveTo(dst string) error {
-	// TODO: check dst is not exist, ok to write
+// SetLimiter :share l with other downloads, set before Run
+func (h *HTTPFile) SetLimiter(l *Limiter) {
+	h.shared = l
+}
+
+// SetObserver :call fn with progress events while Run is active, calls are
+// never concurrent; fn should return quickly
+func (h *HTTPFile) SetObserver(fn func(Event)) {
+	h.observer = &observer{fn: fn}
+}
+
+// Resumed :report whether cached chunks of an earlier run are reused
+func (h *HTTPFile) Resumed() bool {
+	return h.resumed
+}
+
+// Retries :number of retried chunk requests so far
+func (h *HTTPFile) Retries() int {
+	return int(atomic.LoadInt32(&h.retries))
+}
+
+// SetRetry :retry failed chunks according to p
+func (h *HTTPFile) SetRetry(p RetryPolicy) error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("retry attempts must larger or equal to 1")
+	}
+	if p.BaseDelay < 0 || p.MaxDelay < p.BaseDelay {
+		return fmt.Errorf("invalid retry delay: base %s, max %s", p.BaseDelay, p.MaxDelay)
+	}
 
-	if h.Size == 1 {
-		// just move chunk to dst, no need merge
+	h.retry = p
+	return nil
+}
+
+// SaveTo :merge chunks into part file of dst, verify checksum if one was set and
+// move it to dst according to overwrite policy; return path the file was
+// saved to. dst is never seen half written. A checksum mismatch drops the
+// cached download, so the next run fetches it again
+func (h *HTTPFile) SaveTo(dst string) (string, error) {
+	saved, err := h.saveTo(dst)
+	if IsChecksumMismatch(err) {
+		// keeping the bytes would fail the same way forever; should this
+		// fail too, the next run verifies them again
+		h.discard()
+	}
+	return saved, err
+}
+
+func (h *HTTPFile) saveTo(dst string) (string, error) {
+	if h.part != nil {
+		// chunks are already in place, nothing to merge; part file is kept
+		// on failure, so the download could be saved again
+		err := h.part.close()
+		if err != nil {
+			return "", err
+		}
+		if h.checksum != nil {
+			err := h.verifyFile(h.part.path)
+			if err != nil {
+				return "", err
+			}
+		}
+		return h.finalize(h.part.path, dst)
+	}
+
+	tmp := partPath(dst, h.store)
+	if len(h.chunks) == 1 {
+		// just move chunk, no need merge
 		c := h.chunks[0]
-		return os.Rename(c.path, dst)
+		if h.checksum != nil {
+			err := h.verifyFile(c.path)
+			if err != nil {
+				return "", err
+			}
+		}
+		if os.Rename(c.path, tmp) == nil {
+			saved, err := h.finalize(tmp, dst)
+			if err != nil {
+				// keep chunk cached for another try
+				os.Rename(tmp, c.path)
+			}
+			return saved, err
+		}
+		// cache dir is on another device, copy chunk instead
+	}
+
+	err := h.merge(tmp)
+	if err == nil {
+		var saved string
+		saved, err = h.finalize(tmp, dst)
+		if err == nil {
+			return saved, nil
+		}
 	}
+	// chunks are still cached, corrupt or unused output is useless
+	os.Remove(tmp)
+	return "", err
+}
 
-	// merge chunks into target file
-	// output file
-	of, err := os.Create(dst)
+// merge :concat chunks into file p, verify checksum if one was set
+func (h *HTTPFile) merge(p string) error {
+	of, err := os.Create(p)
 	if err != nil {
-		return errors.Wrapf(err, "could not create output file: %s", dst)
+		return errors.Wrapf(err, "could not create output file: %s", p)
 	}
 	defer of.Close()
 
+	// digest is computed while merging, no second read pass needed
+	var w io.Writer = of
+	var sum hash.Hash
+	if h.checksum != nil {
+		sum = h.checksum.newHash()
+		w = io.MultiWriter(of, sum)
+	}
+
 	// concate chunks into one
 	for _, c := range h.chunks {
 		cf, err := os.Open(c.path)
 		if err != nil {
 			return errors.Wrapf(err, "could not open chunk:%s to merge", c.path)
 		}
-		_, err = io.Copy(of, cf)
+		_, err = io.Copy(w, cf)
+		cf.Close()
 		if err != nil {
 			return errors.Wrapf(err, "could not write chunk:%s into merge file", c.path)
 		}
-		cf.Close()
+	}
+
+	if sum != nil {
+		err = h.checksum.verify(sum)
+		if err != nil {
+			return err
+		}
+	}
+	return of.Close()
+}
+
+// verifyFile :compare digest of file p with expected checksum
+func (h *HTTPFile) verifyFile(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return errors.Wrapf(err, "could not open file: %s", p)
+	}
+	defer f.Close()
+
+	sum := h.checksum.newHash()
+	_, err = io.Copy(sum, f)
+	if err != nil {
+		return errors.Wrapf(err, "could not read file: %s", p)
+	}
+	return h.checksum.verify(sum)
+}
+
+// discard :drop cached chunks and part file, keep the entry for the same
+// remote file and output
+func (h *HTTPFile) discard() error {
+	if h.part != nil {
+		h.part.f.Close()
+		err := os.Remove(h.part.path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "could not remove part file: %s", h.part.path)
+		}
+	}
+
+	err := resetStore(h.store)
+	if err == nil {
+		err = h.meta.save(h.store)
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not reset cache dir")
 	}
 	return nil
 }
 
-// Clean :remove all cache chunks and dir
+// Clean :remove all cache chunks and dir, then release it
 func (h *HTTPFile) Clean() error {
-	return os.RemoveAll(h.store)
+	h.closePart()
+	err := os.RemoveAll(h.store)
+	if err != nil || h.lock == nil {
+		return err
+	}
+	err = h.lock.release(true)
+	h.lock = nil
+	return err
+}
+
+// Close :release cache dir, so another process could continue it
+func (h *HTTPFile) Close() error {
+	h.closePart()
+	if h.lock == nil {
+		return nil
+	}
+	err := h.lock.release(false)
+	h.lock = nil
+	return err
+}
+
+// closePart :close part file left open when SaveTo was not reached, its
+// progress is already recorded
+func (h *HTTPFile) closePart() {
+	if h.part != nil {
+		h.part.f.Close()
+	}
+}
+
+// DisableRange :drop cached chunks and download as a single stream
+func (h *HTTPFile) DisableRange() error {
+	h.meta.Range = false
+	err := resetStore(h.store)
+	if err == nil {
+		err = h.meta.save(h.store)
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not reset cache dir")
+	}
+
+	h.Range = false
+	h.worker = 1
+	h.plan()
+	if h.part != nil {
+		// progress recorded in part file is gone with the cache dir
+		return h.SetDirect(h.part.dst)
+	}
+	return nil
+}
+
+// SetPlanner :decide chunk size of a new download with p, call after
+// SetWorker; a resumed download keeps the layout of its cached chunks
+func (h *HTTPFile) SetPlanner(p Planner) error {
+	err := p.validate()
+	if err != nil {
+		return err
+	}
+	if h.resumed || !h.Range {
+		return nil
+	}
+
+	size := p.chunkSize(h.meta.Size, h.worker)
+	if size == h.meta.ChunkSize {
+		return nil
+	}
+
+	h.meta.ChunkSize = size
+	err = h.meta.save(h.store)
+	if err != nil {
+		return err
+	}
+	h.plan()
+	return nil
 }
 
 func (h *HTTPFile) SetWorker(n int) error {
@@ -164,10 +687,13 @@ func (h *HTTPFile) SetWorker(n int) error {
 
 }
 
-func hash(s string) uint32 {
-	h := fnv.New32a()
-	h.Write([]byte(s))
-	return h.Sum32()
+// SetChecksum :verify saved file against c, nil disables verification
+func (h *HTTPFile) SetChecksum(c *Checksum) {
+	h.checksum = c
+}
+
+func singleChunk(dir string, size int64) []*chunk {
+	return []*chunk{&chunk{path: filepath.Join(dir, "stream"), size: size}}
 }
 
 func createDir(p string) error {
@@ -0,0 +1,350 @@
+package httpfile
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer :serve data with ranges and an ETag, slowly enough for idle
+// workers to split active chunks; record ranges and count body bytes its
+// client received
+type testServer struct {
+	*httptest.Server
+	data []byte
+
+	received int64
+	mu       sync.Mutex
+	ranges   []string
+}
+
+func newTestServer(data []byte) *testServer {
+	s := &testServer{data: data}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			s.mu.Lock()
+			s.ranges = append(s.ranges, r.Header.Get("Range"))
+			s.mu.Unlock()
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(slowWriter{w}, r, "f.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	return s
+}
+
+// client :client counting body bytes it received
+func (s *testServer) client() *http.Client {
+	return &http.Client{Transport: countingTransport{s}}
+}
+
+type countingTransport struct {
+	s *testServer
+}
+
+func (t countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err == nil {
+		resp.Body = &countingBody{ReadCloser: resp.Body, n: &t.s.received}
+	}
+	return resp, err
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	return n, err
+}
+
+// requests :Range headers of GET requests since the last call
+func (s *testServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.ranges
+	s.ranges = nil
+	return r
+}
+
+// slowWriter :send body in small pieces with a pause between them
+type slowWriter struct {
+	http.ResponseWriter
+}
+
+func (w slowWriter) Write(b []byte) (int, error) {
+	var total int
+	for len(b) > 0 {
+		n := 16 * 1024
+		if n > len(b) {
+			n = len(b)
+		}
+		m, err := w.ResponseWriter.Write(b[:n])
+		total += m
+		if err != nil {
+			return total, err
+		}
+		b = b[n:]
+		time.Sleep(2 * time.Millisecond)
+	}
+	return total, nil
+}
+
+// openTestFile :HTTPFile of url cached in dir, in direct mode when dst is
+// given; one chunk for the whole file, so workers only get work by splitting
+func openTestFile(t *testing.T, srv *testServer, dir, dst string) *HTTPFile {
+	h, err := NewHTTPFile(srv.client(), srv.URL, dir, Identity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.SetWorker(4)
+	if err == nil {
+		err = h.SetPlanner(Planner{ChunkSize: int64(len(srv.data))})
+	}
+	if err == nil && dst != "" {
+		err = h.SetDirect(dst)
+	}
+	if err != nil {
+		h.Close()
+		t.Fatal(err)
+	}
+	return h
+}
+
+// saveAndCompare :save h to dst and compare it with want
+func saveAndCompare(t *testing.T, h *HTTPFile, dst string, want []byte) {
+	_, err := h.SaveTo(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("saved %d bytes differ from %d bytes served", len(got), len(want))
+	}
+}
+
+func forEachMode(t *testing.T, fn func(t *testing.T, direct bool)) {
+	t.Run("chunks", func(t *testing.T) { fn(t, false) })
+	t.Run("direct", func(t *testing.T) { fn(t, true) })
+}
+
+func TestSplit(t *testing.T) {
+	forEachMode(t, func(t *testing.T, direct bool) {
+		data := testData(3 * 1024 * 1024)
+		srv := newTestServer(data)
+		defer srv.Close()
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		dst := filepath.Join(dir, "f.bin")
+		part := ""
+		if direct {
+			part = dst
+		}
+		h := openTestFile(t, srv, dir, part)
+		defer h.Close()
+		if h.Size != 1 {
+			t.Fatalf("planned %d chunks, want 1", h.Size)
+		}
+
+		err := h.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		saveAndCompare(t, h, dst, data)
+
+		// the probe, the chunk and at least one back half taken over
+		ranges := srv.requests()
+		if len(ranges) < 3 || ranges[1] != "bytes=0-3145727" {
+			t.Errorf("requests %v, want the chunk split", ranges)
+		}
+	})
+}
+
+func TestResume(t *testing.T) {
+	forEachMode(t, func(t *testing.T, direct bool) {
+		data := testData(2 * 1024 * 1024)
+		srv := newTestServer(data)
+		defer srv.Close()
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		dst := filepath.Join(dir, "f.bin")
+		part := ""
+		if direct {
+			part = dst
+		}
+
+		// interrupt first run once a third is received, in the middle of
+		// split chunks
+		h := openTestFile(t, srv, dir, part)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			for atomic.LoadInt64(&srv.received) < int64(len(data))/3 {
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+		}()
+		err := h.Run(ctx)
+		cancel()
+		if err != context.Canceled {
+			t.Fatalf("first run: got %v, want %v", err, context.Canceled)
+		}
+		h.Close()
+		if len(srv.requests()) < 3 {
+			t.Fatal("first run stopped before the chunk was split")
+		}
+		first := atomic.LoadInt64(&srv.received)
+
+		h = openTestFile(t, srv, dir, part)
+		defer h.Close()
+		var resumed int64
+		h.SetObserver(func(e Event) { resumed = e.Resumed })
+		err = h.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		saveAndCompare(t, h, dst, data)
+
+		// every byte received before is reused, only the missing ones are
+		// received again
+		second := atomic.LoadInt64(&srv.received) - first
+		if resumed != first {
+			t.Errorf("resumed %d bytes, want the %d received by first run", resumed, first)
+		}
+		if missing := int64(len(data)) - resumed; second > missing {
+			t.Errorf("second run received %d bytes, want at most the %d missing", second, missing)
+		}
+	})
+}
+
+func TestStreamDirectStalePart(t *testing.T) {
+	const body = "hello world"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			return
+		}
+		// flushed without Content-Length, the length is unknown
+		w.Write([]byte(body))
+		w.(http.Flusher).Flush()
+	}))
+	defer srv.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "out")
+	h, err := NewHTTPFile(http.DefaultClient, srv.URL, dir, Identity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if h.Length >= 0 {
+		t.Fatalf("length %d, want unknown", h.Length)
+	}
+	err = h.SetDirect(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// longer bytes left behind by an older run of the same entry
+	err = ioutil.WriteFile(h.part.path, []byte(strings.Repeat("X", 100)), 0660)
+	if err == nil {
+		err = h.Run(context.Background())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveAndCompare(t, h, dst, []byte(body))
+}
+
+func TestChecksumMismatchDrops(t *testing.T) {
+	forEachMode(t, func(t *testing.T, direct bool) {
+		data := testData(512 * 1024)
+		srv := newTestServer(data)
+		defer srv.Close()
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		dst := filepath.Join(dir, "f.bin")
+		part := ""
+		if direct {
+			part = dst
+		}
+		wrong, err := ParseChecksum("sha256:" + strings.Repeat("0", 64))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := openTestFile(t, srv, dir, part)
+		h.SetChecksum(wrong)
+		err = h.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = h.SaveTo(dst)
+		if !IsChecksumMismatch(err) {
+			t.Fatalf("got %v, want checksum mismatch", err)
+		}
+		h.Close()
+
+		// corrupt bytes are not reused, the next run fetches them anew
+		h = openTestFile(t, srv, dir, part)
+		defer h.Close()
+		var resumed int64 = -1
+		h.SetObserver(func(e Event) { resumed = e.Resumed })
+		err = h.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resumed != 0 {
+			t.Errorf("resumed %d bytes after mismatch, want 0", resumed)
+		}
+		saveAndCompare(t, h, dst, data)
+	})
+}
+
+func TestCloseAfterFailedRun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the probe is answered, chunks fail
+		if r.Method == http.MethodHead || r.Header.Get("Range") == "bytes=0-0" {
+			http.ServeContent(w, r, "f.bin", time.Time{}, bytes.NewReader(testData(1024)))
+			return
+		}
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	defer srv.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	h, err := NewHTTPFile(http.DefaultClient, srv.URL, dir, Identity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.SetDirect(filepath.Join(dir, "out"))
+	if err != nil {
+		h.Close()
+		t.Fatal(err)
+	}
+	if err := h.Run(context.Background()); err == nil {
+		t.Error("run against 404 succeeded")
+	}
+	h.Close()
+
+	if _, err := h.part.f.Stat(); err == nil {
+		t.Error("part file left open by Close")
+	}
+}
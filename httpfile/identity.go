@@ -0,0 +1,96 @@
+package httpfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// IdentityMode :what identifies a download in cache across runs
+type IdentityMode int
+
+const (
+	// IdentityURL :full url, the default
+	IdentityURL IdentityMode = iota
+	// IdentityStrippedURL :url without query parameters of IgnoreQuery, so
+	// a signed url could resume with a fresh signature
+	IdentityStrippedURL
+	// IdentityETag :ETag and size of remote file, wherever it is served
+	// from; falls back to the stripped url when server sends no ETag
+	IdentityETag
+)
+
+// SignedQueryParams :query parameters of S3 and GCS signed urls which
+// change with every signature
+var SignedQueryParams = []string{
+	"X-Amz-Algorithm", "X-Amz-Credential", "X-Amz-Date", "X-Amz-Expires",
+	"X-Amz-SignedHeaders", "X-Amz-Signature", "X-Amz-Security-Token",
+	"X-Goog-Algorithm", "X-Goog-Credential", "X-Goog-Date", "X-Goog-Expires",
+	"X-Goog-SignedHeaders", "X-Goog-Signature",
+	"AWSAccessKeyId", "GoogleAccessId", "Signature", "Expires",
+}
+
+// Identity :how a download is found again in cache, downloads with the same
+// identity share cached chunks
+type Identity struct {
+	Mode IdentityMode `json:"mode"`
+	// IgnoreQuery :query parameters left out of the url, matched case
+	// insensitively; SignedQueryParams when empty
+	IgnoreQuery []string `json:"ignore_query,omitempty"`
+}
+
+// key :identity of url served as r, stored in manifest
+func (id Identity) key(rawurl string, r *remote) (string, error) {
+	switch id.Mode {
+	case IdentityURL:
+		return "url " + rawurl, nil
+	case IdentityETag:
+		if r.etag != "" && r.length >= 0 {
+			return "etag " + r.etag + " " + strconv.FormatInt(r.length, 10), nil
+		}
+	case IdentityStrippedURL:
+	default:
+		return "", errors.Errorf("unknown identity mode %d", id.Mode)
+	}
+
+	stripped, err := id.strip(rawurl)
+	if err != nil {
+		return "", err
+	}
+	return "url " + stripped, nil
+}
+
+// strip :rawurl without ignored query parameters
+func (id Identity) strip(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid url: %s", rawurl)
+	}
+
+	ignore := id.IgnoreQuery
+	if len(ignore) == 0 {
+		ignore = SignedQueryParams
+	}
+
+	q := u.Query()
+	for name := range q {
+		for _, i := range ignore {
+			if strings.EqualFold(name, i) {
+				q.Del(name)
+				break
+			}
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// storeName :cache dir name of key
+func storeName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,147 @@
+package httpfile
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// limitedReadSize :largest read while limited, keeps bursts small
+	limitedReadSize = 16 * 1024
+	// limiterTick :longest sleep before a changed rate is noticed
+	limiterTick = 100 * time.Millisecond
+)
+
+// Limiter :token bucket which caps bytes per second, could be shared by
+// several downloads; rate 0 means unlimited and rate could be changed at
+// any time
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter :limiter allowing rate bytes per second
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate :allow rate bytes per second from now on, 0 is unlimited
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rate < 0 {
+		rate = 0
+	}
+	l.refill(time.Now())
+	l.rate = float64(rate)
+	if l.tokens > l.burst() || l.rate == 0 {
+		l.tokens = l.burst()
+	}
+}
+
+// Rate :bytes per second allowed, 0 is unlimited
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// burst :most tokens saved up while idle, a tenth of a second
+func (l *Limiter) burst() float64 {
+	b := l.rate / 10
+	if b < limitedReadSize {
+		b = limitedReadSize
+	}
+	return b
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst() {
+			l.tokens = l.burst()
+		}
+	}
+	l.last = now
+}
+
+// wait :take n tokens, block until the debt is paid or ctx is done
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	l.mu.Unlock()
+
+	for {
+		l.mu.Lock()
+		l.refill(time.Now())
+		if l.rate == 0 || l.tokens >= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		if d > limiterTick {
+			d = limiterTick
+		}
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// limited :report whether l caps anything
+func (l *Limiter) limited() bool {
+	return l != nil && l.Rate() > 0
+}
+
+// rateReader :read from r no faster than every limiter allows
+type rateReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+func newRateReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	active := make([]*Limiter, 0, len(limiters))
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return r
+	}
+	return &rateReader{ctx: ctx, r: r, limiters: active}
+}
+
+func (r *rateReader) Read(b []byte) (int, error) {
+	for _, l := range r.limiters {
+		if l.limited() && len(b) > limitedReadSize {
+			b = b[:limitedReadSize]
+		}
+	}
+
+	n, err := r.r.Read(b)
+	for _, l := range r.limiters {
+		werr := l.wait(r.ctx, n)
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,111 @@
+package httpfile
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testData :random content of n bytes
+func testData(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// tempDir :new dir, the caller removes it
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "httpfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLimiterReader(t *testing.T) {
+	const rate = 256 * 1024
+	data := testData(rate)
+
+	start := time.Now()
+	r := newRateReader(context.Background(), bytes.NewReader(data), NewLimiter(rate))
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	if !bytes.Equal(got, data) {
+		t.Fatal("content differs")
+	}
+	// one burst is free, the rest takes about a second
+	if elapsed < 800*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("read %d bytes at %d/s in %v, want about 1s", len(data), rate, elapsed)
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	r := newRateReader(ctx, bytes.NewReader(testData(1024*1024)), NewLimiter(64*1024))
+	_, err := ioutil.ReadAll(r)
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRateLimitDownload(t *testing.T) {
+	const rate = 512 * 1024
+	data := testData(rate)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "f.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	h, err := NewHTTPFile(srv.Client(), srv.URL+"/f.bin", dir, Identity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	// every worker shares the cap
+	err = h.SetWorker(4)
+	if err == nil {
+		err = h.SetPlanner(Planner{ChunkSize: 64 * 1024})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetRateLimit(rate)
+
+	start := time.Now()
+	err = h.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	dst := filepath.Join(dir, "f.bin")
+	_, err = h.SaveTo(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content differs")
+	}
+	if elapsed < 800*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("downloaded %d bytes at %d/s in %v, want about 1s", len(data), rate, elapsed)
+	}
+}
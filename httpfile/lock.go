@@ -0,0 +1,241 @@
+package httpfile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	lockSuffix = ".lock"
+
+	// lockPollInterval :how often a locked cache entry is checked again
+	lockPollInterval = time.Second
+)
+
+// errNoLock :file system does not support advisory locks, the owner
+// record in the lock file is all there is
+var errNoLock = errors.New("file locks not supported")
+
+// LockOwner :process holding a cache entry
+type LockOwner struct {
+	PID  int
+	Host string
+}
+
+func (o LockOwner) String() string {
+	if o.PID == 0 {
+		return "another process"
+	}
+	return fmt.Sprintf("pid %d on %s", o.PID, o.Host)
+}
+
+// alive :report whether owner could still be running; a process on another
+// host could not be checked and is taken as alive
+func (o LockOwner) alive() bool {
+	return o.Host != hostname() || processAlive(o.PID)
+}
+
+// LockedError :cache entry is downloaded by another process
+type LockedError struct {
+	// ID :cache entry, as shown by ListCache
+	ID    string
+	Owner LockOwner
+
+	path string
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("cache entry %s is in use by %s", e.ID, e.Owner)
+}
+
+// Wait :block until the entry is released or ctx is done, tick is called on
+// every check and could be nil
+func (e *LockedError) Wait(ctx context.Context, tick func()) error {
+	t := time.NewTicker(lockPollInterval)
+	defer t.Stop()
+	for {
+		if tick != nil {
+			tick()
+		}
+		if released(e.path) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// IsLocked :report whether err means a cache entry is in use by another process
+func IsLocked(err error) bool {
+	_, ok := errors.Cause(err).(*LockedError)
+	return ok
+}
+
+// entryLock :exclusive hold of a cache entry, an advisory lock on a file next
+// to its cache dir which records the owner; the kernel releases the lock of
+// a crashed process, only its record is left
+type entryLock struct {
+	f    *os.File
+	path string
+}
+
+// lockEntry :take cache dir store without waiting; the owner left behind
+// by a crashed process is returned as stale
+func lockEntry(store string) (l *entryLock, stale *LockOwner, err error) {
+	p := store + lockSuffix
+	for {
+		f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0660)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not open lock file: %s", p)
+		}
+		owner := readOwner(f)
+
+		locked, err := tryLock(f)
+		if err == errNoLock {
+			// best effort: taken unless the recorded owner still runs
+			locked, err = owner == nil || !owner.alive(), nil
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, errors.Wrapf(err, "could not lock: %s", p)
+		}
+		if !locked {
+			f.Close()
+			e := &LockedError{ID: filepath.Base(store), path: p}
+			if owner != nil {
+				e.Owner = *owner
+			}
+			return nil, nil, e
+		}
+
+		// the holder before removed the file while we waited for it, the
+		// lock is on a file nobody else sees
+		if !sameFile(f, p) {
+			unlockFile(f)
+			f.Close()
+			continue
+		}
+
+		// record read before could be from a holder which has just released
+		owner = readOwner(f)
+		l = &entryLock{f: f, path: p}
+		err = l.record(fmt.Sprintf("%d %s\n", os.Getpid(), hostname()))
+		if err != nil {
+			l.release(false)
+			return nil, nil, err
+		}
+		return l, owner, nil
+	}
+}
+
+// record :replace owner record in lock file
+func (l *entryLock) record(s string) error {
+	err := l.f.Truncate(0)
+	if err == nil {
+		_, err = l.f.WriteAt([]byte(s), 0)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not write lock file: %s", l.path)
+	}
+	return nil
+}
+
+// release :give up the entry, its lock file is removed with the entry or
+// emptied, so it is not taken for stale
+func (l *entryLock) release(remove bool) error {
+	var err error
+	if remove {
+		err = os.Remove(l.path)
+	} else {
+		err = l.record("")
+	}
+	unlockFile(l.f)
+	l.f.Close()
+	return err
+}
+
+// released :report whether nobody holds lock file p; the lock is taken and
+// given back at once, the owner record is only trusted where file locks are
+// not supported. Errors are left to lockEntry to report
+func released(p string) bool {
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+
+	locked, err := tryLock(f)
+	switch {
+	case err == errNoLock:
+		return lockOwner(p) == nil
+	case err != nil:
+		return true
+	case locked:
+		unlockFile(f)
+	}
+	return locked
+}
+
+// lockOwner :owner recorded in lock file p while it runs, nil when free;
+// the lock itself is left alone, so whoever takes it is never disturbed
+func lockOwner(p string) *LockOwner {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	owner := readOwner(f)
+	if owner == nil || !owner.alive() {
+		return nil
+	}
+	return owner
+}
+
+// readOwner :owner recorded in lock file, nil when there is none
+func readOwner(f *os.File) *LockOwner {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil
+	}
+
+	o := &LockOwner{}
+	_, err = fmt.Sscanf(strings.TrimSpace(string(b)), "%d %s", &o.PID, &o.Host)
+	if err != nil {
+		return nil
+	}
+	return o
+}
+
+// sameFile :report whether f is still what path p names
+func sameFile(f *os.File, p string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pi, err := os.Stat(p)
+	return err == nil && os.SameFile(fi, pi)
+}
+
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return h
+}
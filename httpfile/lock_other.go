@@ -0,0 +1,22 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package httpfile
+
+import (
+	"os"
+)
+
+// tryLock :advisory locks are not used here, owner records only
+func tryLock(f *os.File) (bool, error) {
+	return false, errNoLock
+}
+
+func unlockFile(f *os.File) {}
+
+// processAlive :report whether process pid exists, where it could not be
+// told the process is taken as alive
+func processAlive(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
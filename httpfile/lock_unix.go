@@ -0,0 +1,35 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package httpfile
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// tryLock :take an exclusive flock on f without waiting, false when another
+// open file holds it
+func tryLock(f *os.File) (bool, error) {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	switch err {
+	case nil:
+		return true, nil
+	case unix.EWOULDBLOCK:
+		return false, nil
+	case unix.ENOLCK, unix.EOPNOTSUPP:
+		return false, errNoLock
+	}
+	return false, err
+}
+
+func unlockFile(f *os.File) {
+	unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
+
+// processAlive :report whether process pid exists
+func processAlive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
@@ -0,0 +1,64 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package httpfile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockWait(t *testing.T) {
+	tests := []struct {
+		name  string
+		owner string
+	}{
+		// could not be checked from here, taken as alive
+		{"other host", "1 elsewhere.example.com"},
+		// same host, pid not visible here, e.g. in another pid namespace
+		{"hidden pid", fmt.Sprintf("%d %s", 1<<30, hostname())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			store := filepath.Join(dir, storeName("k"))
+
+			l, _, err := lockEntry(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = l.record(tt.owner + "\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = lockEntry(store)
+			locked, ok := err.(*LockedError)
+			if !ok {
+				t.Fatalf("got %v, want LockedError", err)
+			}
+
+			// held: the owner record must not end the wait
+			ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+			err = locked.Wait(ctx, nil)
+			cancel()
+			if err != context.DeadlineExceeded {
+				t.Fatalf("wait on held lock: got %v, want %v", err, context.DeadlineExceeded)
+			}
+
+			// crashed: the kernel drops the lock, the record is left
+			unlockFile(l.f)
+			l.f.Close()
+			ctx, cancel = context.WithTimeout(context.Background(), 3*lockPollInterval)
+			err = locked.Wait(ctx, nil)
+			cancel()
+			if err != nil {
+				t.Fatalf("wait on released lock: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package httpfile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	manifestName    = "manifest.json"
+	manifestVersion = 2
+)
+
+// manifest :describe planned download, stored next to the chunks
+type manifest struct {
+	Version int `json:"version"`
+	// Key :identity of the download, cache dir is named by its digest
+	Key          string `json:"key"`
+	URL          string `json:"url"`
+	Size         int64  `json:"size"`
+	ChunkSize    int64  `json:"chunk_size"`
+	Range        bool   `json:"range"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	// Output, Identity :where and how the download was started, so cache
+	// resume could continue it
+	Output   string   `json:"output,omitempty"`
+	Identity Identity `json:"identity"`
+}
+
+// loadManifest :read manifest in dir, nil if there is none
+func loadManifest(dir string) (*manifest, error) {
+	p := filepath.Join(dir, manifestName)
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "could not read manifest: %s", p)
+	}
+
+	m := &manifest{}
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse manifest: %s", p)
+	}
+	return m, nil
+}
+
+// save :write manifest into dir, replace the old one atomically
+func (m *manifest) save(dir string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode manifest")
+	}
+
+	p := filepath.Join(dir, manifestName)
+	tmp := p + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0660)
+	if err != nil {
+		return errors.Wrapf(err, "could not write manifest: %s", tmp)
+	}
+	return os.Rename(tmp, p)
+}
+
+// sameRemote :report whether m and o describe the same remote file, url
+// could differ as long as identity is the same
+func (m *manifest) sameRemote(o *manifest) bool {
+	return m.Key == o.Key && m.Size == o.Size &&
+		m.ETag == o.ETag && m.LastModified == o.LastModified
+}
+
+// ifRange :validator sent with If-Range, strong ETag is preferred
+func (m *manifest) ifRange() string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+// openStore :prepare cache dir for m; chunks cached for the same remote
+// file are kept and m adopts their chunk layout, anything else is dropped.
+// report whether cached chunks are resumed and whether they were dropped
+// because the remote file changed
+func openStore(dir string, m *manifest) (resumed, changed bool, err error) {
+	old, err := loadManifest(dir)
+	if err == nil && old != nil && old.Version == m.Version && old.Range == m.Range &&
+		old.ChunkSize > 0 && old.sameRemote(m) {
+		m.ChunkSize = old.ChunkSize
+		if old.URL != m.URL {
+			// remember latest url, like a fresh signature
+			return true, false, m.save(dir)
+		}
+		return true, false, nil
+	}
+
+	// unknown, legacy or different remote file: never mix the data
+	changed = err == nil && old != nil && !old.sameRemote(m)
+	err = resetStore(dir)
+	if err != nil {
+		return false, false, err
+	}
+	return false, changed, m.save(dir)
+}
+
+// resetStore :remove everything in dir and create it again
+func resetStore(dir string) error {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return errors.Wrapf(err, "could not remove cache dir: %s", dir)
+	}
+	return createDir(dir)
+}
@@ -0,0 +1,230 @@
+package httpfile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	partSuffix  = ".part"
+	controlName = "control.json"
+)
+
+// partFile :preallocated output file, every chunk writes its own range
+// with WriteAt; completed ranges are tracked in a control file under the
+// cache dir so download could be resumed
+type partFile struct {
+	f    *os.File
+	dst  string
+	path string
+
+	mu      sync.Mutex
+	control string
+	state   partState
+}
+
+// partState :content of the control file
+type partState struct {
+	Part string `json:"part"`
+	Size int64  `json:"size"`
+
+	// Done :sorted, merged [start, end) ranges already written
+	Done [][2]int64 `json:"done"`
+}
+
+// partPath :dst.<entry>.part, named after the cache entry in store so two
+// entries saved to the same dst never write into one file; the entry lock
+// keeps it to one writer
+func partPath(dst, store string) string {
+	id := filepath.Base(store)
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return dst + "." + id + partSuffix
+}
+
+// openPart :open part file of dst for size bytes, progress recorded in
+// store is reused only when it belongs to the same part file
+func openPart(dst, store string, size int64) (*partFile, error) {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not resolve output path: %s", dst)
+	}
+
+	p := &partFile{
+		dst:     dst,
+		path:    partPath(dst, store),
+		control: filepath.Join(store, controlName),
+	}
+
+	_, statErr := os.Stat(p.path)
+	f, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open part file: %s", p.path)
+	}
+	p.f = f
+
+	err = p.load()
+	if err != nil || statErr != nil || p.state.Part != p.path || p.state.Size != size {
+		// progress does not describe this part file, start over
+		p.state = partState{Part: p.path, Size: size}
+	}
+
+	// unknown length keeps only the recorded bytes, anything after them
+	// is left from an older file
+	length := size
+	if size < 0 {
+		length = p.stored(0, math.MaxInt64)
+	}
+	err = f.Truncate(length)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "could not preallocate part file: %s", p.path)
+	}
+
+	err = p.save()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *partFile) load() error {
+	b, err := ioutil.ReadFile(p.control)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &p.state)
+}
+
+func (p *partFile) save() error {
+	b, err := json.Marshal(&p.state)
+	if err != nil {
+		return errors.Wrap(err, "could not encode control file")
+	}
+
+	tmp := p.control + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0660)
+	if err != nil {
+		return errors.Wrapf(err, "could not write control file: %s", tmp)
+	}
+	return os.Rename(tmp, p.control)
+}
+
+// stored :bytes already written from start on, at most up to end
+func (p *partFile) stored(start, end int64) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, d := range p.state.Done {
+		if d[0] <= start && start < d[1] {
+			if d[1] > end {
+				return end - start
+			}
+			return d[1] - start
+		}
+	}
+	return 0
+}
+
+// starts :offsets where written ranges start
+func (p *partFile) starts() []int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	starts := make([]int64, 0, len(p.state.Done))
+	for _, d := range p.state.Done {
+		starts = append(starts, d[0])
+	}
+	return starts
+}
+
+// commit :record [start, end) as written
+func (p *partFile) commit(start, end int64) error {
+	if start >= end {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	done := make([][2]int64, 0, len(p.state.Done)+1)
+	for _, d := range p.state.Done {
+		switch {
+		case d[1] < start:
+			done = append(done, d)
+		case end < d[0]:
+			done = append(done, [2]int64{start, end})
+			start, end = d[0], d[1]
+		default:
+			// overlapped or adjacent, merge
+			if d[0] < start {
+				start = d[0]
+			}
+			if d[1] > end {
+				end = d[1]
+			}
+		}
+	}
+	p.state.Done = append(done, [2]int64{start, end})
+	return p.save()
+}
+
+// commitStream :record a stream written from the beginning with n bytes,
+// replacing what was recorded before; a part file of unknown length is cut
+// to n, so no older bytes are left after the stream
+func (p *partFile) commitStream(n int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.state.Done = nil
+	if n > 0 {
+		p.state.Done = [][2]int64{{0, n}}
+	}
+	if p.state.Size < 0 {
+		err := p.f.Truncate(n)
+		if err != nil {
+			return errors.Wrapf(err, "could not truncate part file: %s", p.path)
+		}
+	}
+	return p.save()
+}
+
+// writer :sequential writer for chunk range starting at off
+func (p *partFile) writer(off int64) *offsetWriter {
+	return &offsetWriter{f: p.f, off: off}
+}
+
+// close :close part file once every chunk is written, SaveTo moves it
+// into place
+func (p *partFile) close() error {
+	err := p.f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "could not close part file: %s", p.path)
+	}
+	return nil
+}
+
+// offsetWriter :write into f sequentially starting at off
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(b []byte) (int, error) {
+	n, err := w.f.WriteAt(b, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// Close :part file is shared by all chunks, it is closed on finish
+func (w *offsetWriter) Close() error {
+	return nil
+}
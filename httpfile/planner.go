@@ -0,0 +1,65 @@
+package httpfile
+
+import (
+	"fmt"
+)
+
+// chunks every worker gets in auto mode, so a fast worker could pick up
+// work of a slow one
+const chunksPerWorker = 4
+
+// Planner :decide chunk size of a new download, fixed ChunkSize wins over
+// fixed Chunks; without both, size is picked from file size and worker
+// count within Min and Max
+type Planner struct {
+	ChunkSize int64
+	Chunks    int
+	Min, Max  int64
+}
+
+func (p *Planner) validate() error {
+	if p.ChunkSize < 0 || p.Chunks < 0 || p.Min < 0 || p.Max < 0 {
+		return fmt.Errorf("chunk size and count must not be negative")
+	}
+	if p.Min > 0 && p.Max > 0 && p.Min > p.Max {
+		return fmt.Errorf("min chunk size %d larger than max %d", p.Min, p.Max)
+	}
+	return nil
+}
+
+// chunkSize :pick chunk size for size bytes downloaded by worker workers
+func (p *Planner) chunkSize(size int64, worker int) int64 {
+	if p.ChunkSize > 0 {
+		return p.ChunkSize
+	}
+	if size <= 0 {
+		return MinChunkSize
+	}
+	if p.Chunks > 0 {
+		return ceilDiv(size, int64(p.Chunks))
+	}
+
+	min, max := p.Min, p.Max
+	if min == 0 {
+		min = AutoMinChunkSize
+	}
+	if max == 0 {
+		max = AutoMaxChunkSize
+	}
+	if max < min {
+		max = min
+	}
+
+	n := ceilDiv(size, int64(worker*chunksPerWorker))
+	switch {
+	case n < min:
+		return min
+	case n > max:
+		return max
+	}
+	return n
+}
+
+func ceilDiv(a, b int64) int64 {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,84 @@
+package httpfile
+
+import (
+	"context"
+	"sync"
+)
+
+// Pool :cap concurrent chunk connections of every download sharing it, in
+// total and per host; 0 means unlimited
+type Pool struct {
+	total   chan struct{}
+	perHost int
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+// NewPool :pool allowing total connections, at most perHost to one host
+func NewPool(total, perHost int) *Pool {
+	p := &Pool{perHost: perHost, hosts: make(map[string]chan struct{})}
+	if total > 0 {
+		p.total = make(chan struct{}, total)
+	}
+	return p
+}
+
+func (p *Pool) host(name string) chan struct{} {
+	if p.perHost <= 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	slots, ok := p.hosts[name]
+	if !ok {
+		slots = make(chan struct{}, p.perHost)
+		p.hosts[name] = slots
+	}
+	return slots
+}
+
+// acquire :block until a connection to host is allowed or ctx is done
+func (p *Pool) acquire(ctx context.Context, host string) error {
+	if p == nil {
+		return nil
+	}
+
+	// take host slot first, waiting for a busy host must not hold a
+	// slot another host could use
+	slots := p.host(host)
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if p.total != nil {
+		select {
+		case p.total <- struct{}{}:
+		case <-ctx.Done():
+			if slots != nil {
+				<-slots
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// release :give back connection acquired for host
+func (p *Pool) release(host string) {
+	if p == nil {
+		return
+	}
+
+	if p.total != nil {
+		<-p.total
+	}
+	if slots := p.host(host); slots != nil {
+		<-slots
+	}
+}
@@ -0,0 +1,92 @@
+package httpfile
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// remote :what a probe found out about a remote file
+type remote struct {
+	// length :-1 when unknown
+	length  int64
+	rangeOK bool
+	// openRange :server answered a range request, even without a total
+	openRange    bool
+	etag         string
+	lastModified string
+
+	// disposition, contentType :headers naming the file, final :url
+	// after redirects
+	disposition string
+	contentType string
+	final       string
+}
+
+// probe :find out length, range support and validators of url. HEAD is
+// only a hint, which servers often refuse or answer differently than GET;
+// a GET of the first byte decides, its body is closed right away
+func probe(c *http.Client, url string) (*remote, error) {
+	r := &remote{length: -1}
+
+	res, err := c.Head(url)
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			r.length = res.ContentLength
+			r.etag = res.Header.Get("ETag")
+			r.lastModified = res.Header.Get("Last-Modified")
+			r.disposition = res.Header.Get("Content-Disposition")
+			r.contentType = res.Header.Get("Content-Type")
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create http request")
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	res, err = c.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get url")
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		_, _, total, err := parseContentRange(res.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "probe of %s", url)
+		}
+		// unknown total could not be split into chunks
+		r.length, r.rangeOK, r.openRange = total, total >= 0, true
+	case http.StatusOK:
+		// range ignored, whatever HEAD claimed
+		r.length, r.rangeOK = res.ContentLength, false
+	case http.StatusRequestedRangeNotSatisfiable:
+		// empty file has no first byte
+		var total int64
+		_, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes */%d", &total)
+		if err != nil {
+			return nil, fmt.Errorf("could not get resource on url: %s", url)
+		}
+		r.length, r.rangeOK = total, false
+	default:
+		return nil, fmt.Errorf("could not get resource on url: %s", url)
+	}
+
+	// validators of GET win, HEAD may come from another cache
+	etag, lm := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	if etag != "" || lm != "" {
+		r.etag, r.lastModified = etag, lm
+	}
+	if d := res.Header.Get("Content-Disposition"); d != "" {
+		r.disposition = d
+	}
+	if t := res.Header.Get("Content-Type"); t != "" {
+		r.contentType = t
+	}
+	r.final = res.Request.URL.String()
+	return r, nil
+}
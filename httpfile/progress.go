@@ -0,0 +1,161 @@
+package httpfile
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval :how often Run reports progress
+const progressInterval = 500 * time.Millisecond
+
+// worker status reported in WorkerState
+const (
+	WorkerIdle        = "idle"
+	WorkerDownloading = "downloading"
+	WorkerRetrying    = "retrying"
+	WorkerDone        = "done"
+)
+
+// Event :progress of a running download
+type Event struct {
+	// Bytes :bytes stored so far, out of Length; Length is -1 when unknown
+	Bytes, Length int64
+	// Resumed :bytes reused from cache when Run started
+	Resumed int64
+	// Speed :bytes per second over the last interval
+	Speed float64
+
+	// Chunks :planned chunks finished, out of Total
+	Chunks, Total int
+	Retries       int
+	Workers       []WorkerState
+
+	// Done :last event sent by Run
+	Done bool
+}
+
+// WorkerState :what a worker is doing
+type WorkerState struct {
+	ID     int
+	Status string
+	// Chunk :id of the chunk in progress, -1 when there is none
+	Chunk int
+	// Bytes :bytes of chunk already stored, out of Size
+	Bytes, Size int64
+	Retries     int
+}
+
+// observer :deliver events to fn one at a time
+type observer struct {
+	mu sync.Mutex
+	fn func(Event)
+}
+
+func (o *observer) notify(e Event) {
+	if o == nil || o.fn == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.fn(e)
+}
+
+// meter :count bytes written into chunks and derive speed
+type meter struct {
+	bytes int64
+
+	mu     sync.Mutex
+	last   int64
+	lastAt time.Time
+	speed  float64
+}
+
+func (m *meter) add(n int64) {
+	atomic.AddInt64(&m.bytes, n)
+}
+
+func (m *meter) total() int64 {
+	return atomic.LoadInt64(&m.bytes)
+}
+
+// rate :smoothed bytes per second since the previous call
+func (m *meter) rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	n := m.total()
+	if !m.lastAt.IsZero() {
+		if dt := now.Sub(m.lastAt).Seconds(); dt > 0 {
+			cur := float64(n-m.last) / dt
+			m.speed = 0.3*cur + 0.7*m.speed
+		}
+	}
+	m.last, m.lastAt = n, now
+	return m.speed
+}
+
+// countingWriter :feed every byte written through w into m
+type countingWriter struct {
+	w io.WriteCloser
+	m *meter
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.m.add(int64(n))
+	return n, err
+}
+
+func (c *countingWriter) Close() error {
+	return c.w.Close()
+}
+
+// worker :state of one download worker
+type worker struct {
+	mu    sync.Mutex
+	state WorkerState
+	c     *chunk
+}
+
+func newWorkers(n int) []*worker {
+	workers := make([]*worker, n)
+	for i := range workers {
+		workers[i] = &worker{state: WorkerState{ID: i, Status: WorkerIdle, Chunk: -1}}
+	}
+	return workers
+}
+
+func (w *worker) set(status string, c *chunk) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.state.Status = status
+	w.c = c
+	w.state.Chunk = -1
+	if c != nil {
+		w.state.Chunk = c.id
+	}
+}
+
+func (w *worker) retried() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.state.Status = WorkerRetrying
+	w.state.Retries++
+}
+
+func (w *worker) snapshot() WorkerState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := w.state
+	if w.c != nil {
+		s.Bytes, s.Size = w.c.progress()
+	}
+	return s
+}
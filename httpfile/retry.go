@@ -0,0 +1,130 @@
+package httpfile
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy :how often and how long to wait before a failed chunk is
+// requested again, MaxAttempts counts the first request too
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy :policy of a new HTTPFile
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+// delay :exponential backoff with jitter before attempt n+1, a longer
+// Retry-After asked by server is honored up to MaxDelay
+func (p RetryPolicy) delay(n int, err error) time.Duration {
+	d := p.BaseDelay << uint(n-1)
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	// jitter: somewhere between half and full delay
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+
+	if e, ok := errors.Cause(err).(*StatusError); ok && e.RetryAfter > d {
+		d = e.RetryAfter
+		if d > p.MaxDelay {
+			d = p.MaxDelay
+		}
+	}
+	return d
+}
+
+// StatusError :server answered a chunk request with an error status
+type StatusError struct {
+	Chunk      int
+	Status     int
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return "chunk-" + strconv.Itoa(e.Chunk) + ": server answered " + strconv.Itoa(e.Status) + " " + http.StatusText(e.Status)
+}
+
+func newStatusError(c *chunk, resp *http.Response) *StatusError {
+	return &StatusError{
+		Chunk:      c.id,
+		Status:     resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter :parse Retry-After given in seconds or as http date
+func parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// IsRetryable :report whether err is transient: network errors, bodies cut
+// short, 5xx, 429 and 408; anything else like 404, 410, 401 or 403, a
+// certificate which could not be verified, a redirect loop or an unsupported
+// scheme is permanent
+func IsRetryable(err error) bool {
+	err = errors.Cause(err)
+	if e, ok := err.(*url.Error); ok {
+		// url.Error is a net.Error whatever it wraps, judge the cause
+		if e.Timeout() {
+			return true
+		}
+		err = errors.Cause(e.Err)
+		if err == io.EOF {
+			// connection closed before a response
+			return true
+		}
+	}
+	if isTLSError(err) {
+		return false
+	}
+
+	switch e := err.(type) {
+	case *StatusError:
+		return e.Status >= 500 || e.Status == http.StatusTooManyRequests ||
+			e.Status == http.StatusRequestTimeout
+	case net.Error:
+		return true
+	}
+	return err == io.ErrUnexpectedEOF
+}
+
+// isTLSError :report whether err means the server could not be verified or
+// spoke no TLS, asking again gives the same answer
+func isTLSError(err error) bool {
+	if isVerificationError(err) {
+		return true
+	}
+	switch err.(type) {
+	case x509.UnknownAuthorityError, x509.CertificateInvalidError,
+		x509.HostnameError, x509.SystemRootsError, x509.ConstraintViolationError,
+		x509.UnhandledCriticalExtension, tls.RecordHeaderError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package httpfile
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestIsRetryable(t *testing.T) {
+	urlErr := func(err error) error {
+		return errors.Wrap(&url.Error{Op: "Get", URL: "https://example.com/f", Err: err}, "could not get src file")
+	}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"503", &StatusError{Status: 503}, true},
+		{"429", &StatusError{Status: 429}, true},
+		{"404", &StatusError{Status: 404}, false},
+		{"cut short", errors.Wrap(io.ErrUnexpectedEOF, "copy"), true},
+		{"connection reset", urlErr(reset), true},
+		{"closed before response", urlErr(io.EOF), true},
+		{"pin mismatch", urlErr(errors.New("public key of server is not pinned")), false},
+		{"redirect loop", urlErr(errors.New("stopped after 10 redirects")), false},
+		{"local", errors.New("disk full"), false},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("%s: IsRetryable(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestIsRetryableTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// failed handshakes are expected
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		c    *http.Client
+		url  string
+	}{
+		{"unknown authority", &http.Client{}, srv.URL},
+		// certificate is for 127.0.0.1 and example.com
+		{"wrong host", srv.Client(), "https://localhost:" + u.Port()},
+	}
+	for _, tt := range tests {
+		_, err := tt.c.Get(tt.url)
+		if err == nil {
+			t.Fatalf("%s: request succeeded", tt.name)
+		}
+		e, ok := err.(*url.Error)
+		if !ok || !isTLSError(e.Err) {
+			t.Errorf("%s: %#v not taken for a tls error", tt.name, err)
+		}
+		if IsRetryable(errors.Wrap(err, "could not get src file")) {
+			t.Errorf("%s: IsRetryable(%v) = true, want false", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package httpfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// OverwritePolicy :what SaveTo does when dst already exists
+type OverwritePolicy int
+
+const (
+	// Overwrite :replace dst
+	Overwrite OverwritePolicy = iota
+	// NoClobber :keep dst and fail with ErrOutputExists
+	NoClobber
+	// Rename :save as file.1.iso, file.2.iso, ... next to dst
+	Rename
+)
+
+// SetOverwrite :apply p when dst of SaveTo exists
+func (h *HTTPFile) SetOverwrite(p OverwritePolicy) {
+	h.overwrite = p
+}
+
+// SetSync :flush saved file and its directory to disk before SaveTo
+// returns, so it survives a crash
+func (h *HTTPFile) SetSync(sync bool) {
+	h.sync = sync
+}
+
+// Exists :report whether SaveTo(dst) would fail because of NoClobber
+func (h *HTTPFile) Exists(dst string) bool {
+	if h.overwrite != NoClobber {
+		return false
+	}
+	_, err := os.Lstat(dst)
+	return err == nil
+}
+
+// finalize :move complete file src into place according to overwrite
+// policy, return path it was saved to
+func (h *HTTPFile) finalize(src, dst string) (string, error) {
+	if h.sync {
+		err := syncFile(src)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var err error
+	saved := dst
+	switch h.overwrite {
+	case NoClobber:
+		err = moveNew(src, dst)
+	case Rename:
+		for i := 1; ; i++ {
+			err = moveNew(src, saved)
+			if !IsOutputExists(err) {
+				break
+			}
+			saved = numbered(dst, i)
+		}
+	default:
+		err = os.Rename(src, dst)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if h.sync {
+		err = syncFile(filepath.Dir(saved))
+		if err != nil {
+			return "", err
+		}
+	}
+	return saved, nil
+}
+
+// moveNew :move src to dst unless dst exists; a hard link fails atomically
+// when dst exists, without link support dst is checked before rename
+func moveNew(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return os.Remove(src)
+	}
+	if os.IsExist(err) {
+		return errors.Wrapf(ErrOutputExists, "%s", dst)
+	}
+
+	if _, err := os.Lstat(dst); err == nil {
+		return errors.Wrapf(ErrOutputExists, "%s", dst)
+	}
+	return os.Rename(src, dst)
+}
+
+// numbered :dst with n before its extension, file.iso becomes file.1.iso
+// and file.tar.gz becomes file.1.tar.gz
+func numbered(dst string, n int) string {
+	dir, name := filepath.Split(dst)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if strings.HasSuffix(base, ".tar") {
+		base, ext = strings.TrimSuffix(base, ".tar"), ".tar"+ext
+	}
+	if base == "" {
+		// hidden file like .bashrc has no extension
+		base, ext = name, ""
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s.%d%s", base, n, ext))
+}
+
+// syncFile :flush file or directory p to disk
+func syncFile(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return errors.Wrapf(err, "could not open for sync: %s", p)
+	}
+	defer f.Close()
+
+	err = f.Sync()
+	if err != nil {
+		return errors.Wrapf(err, "could not sync: %s", p)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package httpfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// minSplitSize :smallest range an idle worker takes over from an active chunk
+const minSplitSize = int64(256 * KB)
+
+// scheduler :hand out planned chunks to workers; once none is queued, an
+// idle worker takes over the back half of the largest active chunk
+type scheduler struct {
+	mu     sync.Mutex
+	queue  []*chunk
+	chunks *[]*chunk
+	split  bool
+	nextID int
+}
+
+func newScheduler(chunks *[]*chunk, split bool) *scheduler {
+	return &scheduler{
+		queue:  append([]*chunk(nil), *chunks...),
+		chunks: chunks,
+		split:  split,
+		nextID: len(*chunks),
+	}
+}
+
+// next :chunk to download next, nil when nothing is left to do
+func (s *scheduler) next() *chunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) > 0 {
+		c := s.queue[0]
+		s.queue = s.queue[1:]
+		return c
+	}
+	if !s.split {
+		return nil
+	}
+
+	var largest *chunk
+	var most int64
+	for _, c := range *s.chunks {
+		if left := c.left(); left > most {
+			largest, most = c, left
+		}
+	}
+	if largest == nil {
+		return nil
+	}
+
+	t := largest.split(s.nextID, minSplitSize)
+	if t == nil {
+		return nil
+	}
+	s.nextID++
+
+	// keep chunks ordered by offset, SaveTo merges them in this order
+	chunks := append(*s.chunks, t)
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].offset() < chunks[j].offset()
+	})
+	*s.chunks = chunks
+	return t
+}
+
+// restoreTails :split chunks again at the back halves an interrupted run
+// took over, their bytes are cached apart from the chunk they came from:
+// in a chunk file named after their offset, or in a range of the part file
+func restoreTails(chunks []*chunk, store string, part *partFile) ([]*chunk, error) {
+	starts, err := tailStarts(store, part)
+	if err != nil || len(starts) == 0 {
+		return chunks, err
+	}
+
+	restored := make([]*chunk, 0, len(chunks))
+	id := len(chunks)
+	for _, c := range chunks {
+		restored = append(restored, c)
+		if c.r == nil {
+			continue
+		}
+
+		var inside []int64
+		for start := range starts {
+			if c.r.start < start && start <= c.r.end {
+				inside = append(inside, start)
+			}
+		}
+		sort.Slice(inside, func(i, j int) bool { return inside[i] < inside[j] })
+
+		front := c
+		for _, start := range inside {
+			path := starts[start]
+			if path == "" {
+				path = fmt.Sprintf("%s-%d", front.path, start)
+			}
+			t := &chunk{
+				id:   id,
+				r:    &Range{start, front.r.end},
+				path: path,
+				size: front.r.end - start + 1,
+				tail: true,
+				part: part,
+			}
+			id++
+
+			front.r.end = start - 1
+			front.size = front.r.end - front.r.start + 1
+			restored = append(restored, t)
+			front = t
+		}
+	}
+	return restored, nil
+}
+
+// tailStarts :offsets where back halves start, with the chunk file of
+// each; a part file records them as the start of a written range
+func tailStarts(store string, part *partFile) (map[int64]string, error) {
+	starts := make(map[int64]string)
+	if part != nil {
+		for _, start := range part.starts() {
+			starts[start] = ""
+		}
+		return starts, nil
+	}
+
+	infos, err := ioutil.ReadDir(store)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read cache dir: %s", store)
+	}
+	for _, fi := range infos {
+		// chunk-<id>-<offset>, split again chunk-<id>-<offset>-<offset>
+		fields := strings.Split(fi.Name(), "-")
+		if len(fields) < 3 || fields[0] != "chunk" {
+			continue
+		}
+		start, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		if err != nil {
+			continue
+		}
+		starts[start] = filepath.Join(store, fi.Name())
+	}
+	return starts, nil
+}
@@ -0,0 +1,135 @@
+package httpfile
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxSourceFailures :failures in a row after which a source is dropped
+const maxSourceFailures = 3
+
+// source :one url serving the remote file
+type source struct {
+	url string
+	// validator :If-Range validator of this url, mirrors have their own
+	validator string
+
+	speed    float64
+	failures int
+	dropped  bool
+}
+
+// sourceSet :urls serving the same remote file, chunks are spread over
+// them weighted by speed
+type sourceSet struct {
+	mu   sync.Mutex
+	list []*source
+}
+
+func (s *sourceSet) add(src *source) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.list = append(s.list, src)
+}
+
+// pick :alive source chosen at random weighted by speed, a source not
+// measured yet weighs as much as the fastest one so it gets tried
+func (s *sourceSet) pick() *source {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fastest := 1.0
+	for _, src := range s.list {
+		if !src.dropped && src.speed > fastest {
+			fastest = src.speed
+		}
+	}
+
+	var alive []*source
+	var weights []float64
+	var total float64
+	for _, src := range s.list {
+		if src.dropped {
+			continue
+		}
+		w := src.speed
+		if w == 0 {
+			w = fastest
+		}
+		alive = append(alive, src)
+		weights = append(weights, w)
+		total += w
+	}
+
+	x := rand.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return alive[i]
+		}
+		x -= w
+	}
+	return alive[len(alive)-1]
+}
+
+// done :request to src received n bytes in d and ended with err; report
+// whether src got dropped, the last alive source never is
+func (s *sourceSet) done(src *source, n int64, d time.Duration, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n > 0 && d > 0 {
+		cur := float64(n) / d.Seconds()
+		if src.speed == 0 {
+			src.speed = cur
+		} else {
+			src.speed = 0.5*cur + 0.5*src.speed
+		}
+	}
+
+	if err == nil {
+		src.failures = 0
+		return false
+	}
+	src.failures++
+
+	var alive int
+	for _, o := range s.list {
+		if !o.dropped {
+			alive++
+		}
+	}
+	if alive > 1 && (src.failures >= maxSourceFailures || !IsRetryable(err)) {
+		src.dropped = true
+	}
+	return src.dropped
+}
+
+// isSourceError :report whether err was caused by the server or the way to
+// it; local failures like a full disk count against no source
+func isSourceError(err error) bool {
+	err = errors.Cause(err)
+	switch err.(type) {
+	case *StatusError, *RangeError, net.Error:
+		return true
+	}
+	return err == ErrRemoteChanged || err == io.ErrUnexpectedEOF
+}
+
+// urls :urls of sources still in use
+func (s *sourceSet) urls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var urls []string
+	for _, src := range s.list {
+		if !src.dropped {
+			urls = append(urls, src.url)
+		}
+	}
+	return urls
+}
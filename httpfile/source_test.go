@@ -0,0 +1,32 @@
+package httpfile
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestIsSourceError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"status", &StatusError{Status: 404}, true},
+		{"range", &RangeError{Status: 200}, true},
+		{"changed", errors.Wrapf(ErrRemoteChanged, "chunk-1"), true},
+		{"cut short", errors.Wrap(io.ErrUnexpectedEOF, "copy"), true},
+		{"network", &url.Error{Op: "Get", URL: "http://example.com", Err: io.EOF}, true},
+		{"create", errors.Wrap(&os.PathError{Op: "open", Path: "chunk-1", Err: syscall.EACCES}, "could not create dst file"), false},
+		{"disk full", errors.Wrap(&os.PathError{Op: "write", Path: "chunk-1", Err: syscall.ENOSPC}, "could not copy download content into dst file"), false},
+	}
+	for _, tt := range tests {
+		if got := isSourceError(tt.err); got != tt.want {
+			t.Errorf("%s: isSourceError(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
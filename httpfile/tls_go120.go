@@ -0,0 +1,15 @@
+//go:build go1.20
+// +build go1.20
+
+package httpfile
+
+import (
+	"crypto/tls"
+)
+
+// isVerificationError :report whether err is a certificate of the server
+// which failed verification, the x509 error is wrapped since Go 1.20
+func isVerificationError(err error) bool {
+	_, ok := err.(*tls.CertificateVerificationError)
+	return ok
+}
@@ -0,0 +1,9 @@
+//go:build !go1.20
+// +build !go1.20
+
+package httpfile
+
+// isVerificationError :x509 errors are returned as they are before Go 1.20
+func isVerificationError(err error) bool {
+	return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"godownloader/httpfile"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// lockMode :what a download does when another process holds its cache entry
+type lockMode int
+
+const (
+	// lockFail :give up at once
+	lockFail lockMode = iota
+	// lockWait :wait until it is released, then continue the entry
+	lockWait
+	// lockObserve :report progress of the other process while waiting; when
+	// it saved the same output there is nothing left to do
+	lockObserve
+)
+
+// observeInterval :how often progress of another process is reported
+const observeInterval = 5 * time.Second
+
+// errSavedElsewhere :the process holding the cache entry saved the file
+var errSavedElsewhere = errors.New("saved by another process")
+
+func parseLockMode(s string) (lockMode, error) {
+	switch s {
+	case "fail":
+		return lockFail, nil
+	case "wait":
+		return lockWait, nil
+	case "observe":
+		return lockObserve, nil
+	}
+	return 0, errors.Errorf("unknown -lock %q, want fail, wait or observe", s)
+}
+
+// waitLock :wait for the process holding the cache entry of j, err is the
+// LockedError of NewHTTPFile; report whether that process saved j already
+func waitLock(ctx context.Context, j *job, dir string, cfg config, d display, err error) (bool, error) {
+	locked := errors.Cause(err).(*httpfile.LockedError)
+	if cfg.lock == lockWait {
+		d.printf(j, "%v, waiting", locked)
+		return false, locked.Wait(ctx, nil)
+	}
+
+	d.printf(j, "%v, observing", locked)
+	var (
+		last     *httpfile.CacheEntry
+		reported time.Time
+	)
+	err = locked.Wait(ctx, func() {
+		e, err := httpfile.FindCache(dir, locked.ID)
+		if err != nil {
+			return
+		}
+		last = e
+		if time.Since(reported) >= observeInterval {
+			reported = time.Now()
+			d.printf(j, "%s downloaded %s of %s", locked.Owner, entryDone(e), entrySize(e))
+		}
+	})
+	if err != nil || last == nil || len(last.Output) == 0 {
+		return false, err
+	}
+
+	// a cache entry is only removed once it is saved, anything else is
+	// continued by this process
+	if _, err := os.Stat(last.Path); !os.IsNotExist(err) {
+		return false, nil
+	}
+	if len(j.dst) != 0 {
+		dst, err := filepath.Abs(j.dst)
+		if err != nil || dst != last.Output {
+			return false, nil
+		}
+	}
+	if _, err := os.Stat(last.Output); err != nil {
+		return false, nil
+	}
+
+	j.dst = last.Output
+	d.printf(j, "saved to %s by %s", last.Output, locked.Owner)
+	return true, nil
+}
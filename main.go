@@ -1,18 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"godownloader/httpfile"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"path"
 	"strings"
-	"time"
+	"syscall"
 
-	pb "gopkg.in/cheggaaa/pb.v1"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -20,97 +23,502 @@ const (
 	BaseDirMode = 0755
 )
 
+const (
+	// exit code when saved file does not match -checksum
+	ExitChecksum = 3
+	// exit code when download is interrupted by a signal
+	ExitInterrupted = 130
+)
+
+// config :download settings from command line, shared by every job
+type config struct {
+	worker   int
+	retry    int
+	direct   bool
+	sync     bool
+	policy   httpfile.OverwritePolicy
+	identity httpfile.Identity
+	lock     lockMode
+	planner  httpfile.Planner
+	limiter  *httpfile.Limiter
+	connRate int64
+	pool     *httpfile.Pool
+
+	// header :sent with every request, jar :cookies to send,
+	// netrc :credentials per host
+	header http.Header
+	jar    http.CookieJar
+	netrc  *netrc
+
+	// transport :connections shared by every download
+	transport http.RoundTripper
+
+	// outputs :output files claimed by running jobs of a batch, nil for a
+	// single download
+	outputs *outputLocks
+}
+
 // below variable assign by compiler
 var (
 	Version string
 	Build   string
 )
 
+// job :one file to download, dst is empty until resolved from response
+type job struct {
+	src, dst string
+	mirrors  []string
+	checksum *httpfile.Checksum
+	header   http.Header
+
+	// release :give up output claimed in cfg.outputs, nil if none
+	release func()
+}
+
+// name :how j is shown in messages
+func (j *job) name() string {
+	if len(j.dst) != 0 {
+		return j.dst
+	}
+	return j.src
+}
+
 func main() {
 	url := flag.String("u", "", "the url to download")
-	output := flag.String("o", "", "output path")
+	output := flag.String("o", "", "output path (default name from Content-Disposition or url)")
+	var mirrors stringList
+	flag.Var(&mirrors, "mirror", "another url of the same file, could be repeated")
+	input := flag.String("i", "", "download urls listed in file, - for stdin")
+	parallel := flag.Int("j", 3, "files downloaded at the same time with -i")
+	maxConn := flag.Int("max-conn", 0, "cap connections of all downloads (default unlimited)")
+	maxConnPerHost := flag.Int("max-conn-per-host", 0, "cap connections to one host (default unlimited)")
+	var headers stringList
+	flag.Var(&headers, "H", "extra header 'Name: value' sent with every request, could be repeated")
+	userPass := flag.String("user", "", "basic auth credentials user:pass")
+	bearer := flag.String("bearer", "", "bearer token sent as Authorization")
+	cookieFile := flag.String("cookie-file", "", "send cookies from a Netscape format cookie file")
+	netrcFile := flag.String("netrc-file", "", "read credentials per host from this file (default ~/.netrc)")
+	noNetrc := flag.Bool("no-netrc", false, "do not read credentials from .netrc")
+	proxy := flag.String("proxy", "", "proxy url, http://, https:// or socks5://, user:pass@ allowed (default from environment)")
+	noProxy := flag.String("no-proxy", "", "comma separated hosts, domains, ip or cidr connected without proxy")
+	var tlsOpts tlsOptions
+	flag.StringVar(&tlsOpts.caCert, "cacert", "", "verify servers with ca certificates in this PEM file instead of system ones")
+	flag.StringVar(&tlsOpts.caPath, "capath", "", "verify servers with ca certificates in PEM files of this directory instead of system ones")
+	flag.StringVar(&tlsOpts.cert, "cert", "", "client certificate PEM file, could hold the key too")
+	flag.StringVar(&tlsOpts.key, "key", "", "private key PEM file of -cert")
+	flag.BoolVar(&tlsOpts.insecure, "insecure", false, "do not verify server certificates (dangerous)")
+	flag.StringVar(&tlsOpts.pinnedPubKey, "pinnedpubkey", "", "accept only servers with this public key, sha256//<base64>[;sha256//<base64>]")
+	verbose := flag.Bool("v", false, "verbose output")
 	worker := flag.Int("w", 6, "worker to download")
+	retry := flag.Int("retry", httpfile.DefaultRetryPolicy.MaxAttempts, "attempts per chunk on transient errors")
+	checksum := flag.String("checksum", "", "verify output, format algo:hex (md5, sha1, sha256, sha512)")
+	overwrite := flag.Bool("overwrite", false, "replace an existing output file")
+	noClobber := flag.Bool("no-clobber", false, "keep an existing output file and fail (default)")
+	rename := flag.Bool("rename", false, "save as file.1.iso, file.2.iso, ... when output file exists")
+	cacheDir := flag.String("cache-dir", "", "keep cached chunks in this dir (default $XDG_CACHE_HOME/godownloader or ~/.godownloader)")
+	lock := flag.String("lock", "fail", "when another process downloads the same file: fail, wait or observe its progress")
+	cacheKey := flag.String("cache-key", "url", "what finds a download in cache again: url, url-stripped or etag")
+	cacheIgnoreQuery := flag.String("cache-ignore-query", "", "comma separated query parameters left out by -cache-key url-stripped (default S3 and GCS signature parameters)")
+	fsync := flag.Bool("fsync", false, "flush output file and its directory to disk before finishing")
+	direct := flag.Bool("direct", false, "write into preallocated <output>.<id>.part instead of chunk files")
+	chunkSize := flag.String("chunk-size", "", "size of each chunk, e.g. 8MB (default auto)")
+	chunks := flag.Int("chunks", 0, "number of chunks (default auto)")
+	limitRate := flag.String("limit-rate", "", "cap download speed, e.g. 2MB (per second)")
+	limitConnRate := flag.String("limit-conn-rate", "", "cap speed of every connection, e.g. 512KB (per second)")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Version %s\n", Version)
 		fmt.Fprintf(os.Stderr, "Build %s\n", Build)
 		fmt.Fprintln(os.Stderr, "usage:")
 		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, cacheUsage)
 	}
 	flag.Parse()
 
-	// setup source and destination path
-	var src string
-	if len(*url) == 0 {
-		if flag.NArg() == 0 {
-			fmt.Fprintf(os.Stderr, "%s <<url>>", os.Args[0])
-			os.Exit(1)
+	policy, err := overwritePolicy(*overwrite, *noClobber, *rename)
+	failOnErr(err)
+
+	identity, err := cacheIdentity(*cacheKey, *cacheIgnoreQuery)
+	failOnErr(err)
+
+	cfg := config{worker: *worker, retry: *retry, direct: *direct, sync: *fsync, policy: policy, identity: identity}
+	cfg.lock, err = parseLockMode(*lock)
+	failOnErr(err)
+	cfg.planner.Chunks = *chunks
+	if len(*chunkSize) != 0 {
+		size, err := httpfile.ParseByteSize(*chunkSize)
+		failOnErr(err)
+		if size == 0 {
+			log.Fatal("chunk size must larger than 0")
 		}
-		src = flag.Arg(0)
-	} else {
-		src = *url
+		cfg.planner.ChunkSize = int64(size)
 	}
 
-	var dst string
-	if len(*output) == 0 {
-		dst = subLastSlash(src)
-	} else {
-		dst = *output
+	rate, err := parseRate(*limitRate)
+	failOnErr(err)
+	cfg.limiter = httpfile.NewLimiter(rate)
+	cfg.connRate, err = parseRate(*limitConnRate)
+	failOnErr(err)
+	cfg.pool = httpfile.NewPool(*maxConn, *maxConnPerHost)
+
+	pc := &proxyConfig{noProxy: parseNoProxy(*noProxy), verbose: *verbose}
+	pc.url, err = parseProxy(*proxy)
+	failOnErr(err)
+	tlsConfig, err := newTLSConfig(tlsOpts)
+	failOnErr(err)
+	cfg.transport = newTransport(pc, tlsConfig)
+
+	cfg.header, err = parseAuth(headers, *userPass, *bearer)
+	failOnErr(err)
+	if len(*cookieFile) != 0 {
+		cfg.jar, err = loadCookies(*cookieFile)
+		failOnErr(err)
 	}
 
 	// setup base dir
 	home, err := getUserHome()
 	failOnErr(err)
 
-	dir := path.Join(home, BaseDir)
+	if !*noNetrc {
+		if len(*netrcFile) != 0 {
+			cfg.netrc, err = loadNetrc(*netrcFile, true)
+		} else {
+			cfg.netrc, err = loadNetrc(path.Join(home, ".netrc"), false)
+		}
+		failOnErr(err)
+	}
+
+	dir := cacheRoot(*cacheDir, home)
 	err = createDir(dir)
 	failOnErr(err)
 
-	// create file client
-	client := http.DefaultClient
-	h, err := httpfile.NewHTTPFile(client, src, dir)
-	failOnErr(err)
+	// stop download on interrupt, cached chunks are kept for next run
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
 
-	if h.Range {
-		err = h.SetWorker(*worker)
+	if flag.NArg() > 0 && flag.Arg(0) == "cache" {
+		runCache(ctx, flag.Args()[1:], dir, cfg)
+		return
+	}
+
+	if len(*input) != 0 {
+		jobs, err := readJobs(*input)
 		failOnErr(err)
+		if *parallel < 1 {
+			log.Fatal("parallel downloads must larger or equal to 1")
+		}
+		os.Exit(runBatch(ctx, jobs, dir, cfg, *parallel))
 	}
 
-	// download chuncks
-	fmt.Fprintf(os.Stdout, "start download %s", src)
-	chuncks, errs := h.Download()
-	failOnErr(err)
+	// setup source and destination path
+	var j job
+	if len(*url) == 0 {
+		if flag.NArg() == 0 {
+			fmt.Fprintf(os.Stderr, "%s <<url>>", os.Args[0])
+			os.Exit(1)
+		}
+		j.src = flag.Arg(0)
+	} else {
+		j.src = *url
+	}
 
-	bar := pb.StartNew(h.Size)
-	bar.SetRefreshRate(time.Second)
-	bar.ShowTimeLeft = false
+	// without -o the name is resolved once the server answered
+	j.dst = *output
 
-	var count int
-loop:
-	for {
-		select {
-		case <-chuncks:
+	j.mirrors = mirrors
+	if len(*checksum) != 0 {
+		j.checksum, err = httpfile.ParseChecksum(*checksum)
+		failOnErr(err)
+	}
 
-			bar.Increment()
-			count++
+	err = fetch(ctx, &j, dir, cfg, &barDisplay{})
+	exitOnFetchErr(err)
+}
 
-			if count == h.Size {
-				bar.Finish()
-				break loop
-			}
-		case err := <-errs:
-			log.Fatal(err)
-			return
+// exitOnFetchErr :exit with the code matching err of a single fetch
+func exitOnFetchErr(err error) {
+	if errors.Cause(err) == context.Canceled {
+		fmt.Fprintln(os.Stderr, "download interrupted, run again to resume")
+		os.Exit(ExitInterrupted)
+	}
+	if httpfile.IsChecksumMismatch(err) {
+		// corrupt bytes are dropped from cache, another run fetches them anew
+		log.Print(err)
+		fmt.Fprintln(os.Stderr, "cached download dropped, run again to download it anew")
+		os.Exit(ExitChecksum)
+	}
+	failOnErr(err)
+}
+
+// fetch :download j and save it, fallback to a single stream when ranges
+// are not supported and start over once when the remote file changed
+func fetch(ctx context.Context, j *job, dir string, cfg config, d display) error {
+	client := newClient(cfg, j)
+	h, err := openFile(ctx, client, j, dir, cfg, d)
+	if err == errSavedElsewhere {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// another process could continue once we are done, Clean releases earlier
+	defer func() { h.Close() }()
+
+	// download chuncks
+	d.printf(j, "start download %s", j.src)
+	err = download(ctx, j, h, d)
+	if httpfile.IsRangeNotSupported(err) {
+		d.printf(j, "server ignored range request, fallback to single stream")
+		err = h.DisableRange()
+		if err != nil {
+			return err
 		}
+		err = download(ctx, j, h, d)
+	}
+	if httpfile.IsRemoteChanged(err) {
+		// chunks already downloaded belong to an older file, start over once
+		d.printf(j, "remote file changed during download (%v), restart download", err)
+		err = h.Clean()
+		if err != nil {
+			return err
+		}
+		h, err = openFile(ctx, client, j, dir, cfg, d)
+		if err == errSavedElsewhere {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = download(ctx, j, h, d)
+	}
+	if err != nil {
+		return err
 	}
 
 	// merge chunks and save
-	fmt.Fprintf(os.Stdout, "save to %s\n", dst)
-	err = h.SaveTo(dst)
-	failOnErr(err)
+	saved, err := h.SaveTo(j.dst)
+	if err != nil {
+		return err
+	}
+	j.dst = saved
+	d.printf(j, "saved to %s", saved)
 
 	// clean cache
-	err = h.Clean()
-	failOnErr(err)
+	return h.Clean()
+}
+
+// openFile :probe remote file, take its cache entry and plan its chunks;
+// errSavedElsewhere when the process it was waiting for saved j
+func openFile(ctx context.Context, client *http.Client, j *job, dir string, cfg config, d display) (*httpfile.HTTPFile, error) {
+	h, err := httpfile.NewHTTPFile(client, j.src, dir, cfg.identity)
+	for httpfile.IsLocked(err) && cfg.lock != lockFail {
+		var saved bool
+		saved, err = waitLock(ctx, j, dir, cfg, d, err)
+		if err != nil {
+			return nil, err
+		}
+		if saved {
+			return nil, errSavedElsewhere
+		}
+		h, err = httpfile.NewHTTPFile(client, j.src, dir, cfg.identity)
+	}
+	if httpfile.IsLocked(err) {
+		return nil, errors.Wrap(err, "same file is downloaded by another process, use -lock wait or -lock observe")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if h.StaleLock != nil {
+		d.printf(j, "stale lock of %s taken over, that run did not finish", h.StaleLock)
+	}
+	err = prepareFile(h, j, cfg, d)
+	if err != nil {
+		// an entry created just now holds nothing worth keeping
+		if h.Resumed() {
+			h.Close()
+		} else {
+			h.Clean()
+		}
+		return nil, err
+	}
+	return h, nil
+}
+
+// prepareFile :apply settings of cfg and j to h
+func prepareFile(h *httpfile.HTTPFile, j *job, cfg config, d display) error {
+	if h.RemoteChanged {
+		d.printf(j, "remote file changed since last run, cached chunks discarded")
+	}
+
+	if len(j.dst) == 0 {
+		j.dst = h.Filename
+	}
+	if cfg.outputs != nil && j.release == nil {
+		// another job saving to the same file waits until this one is done
+		release, err := cfg.outputs.lock(j.dst)
+		if err != nil {
+			return err
+		}
+		j.release = release
+	}
+
+	// fail before downloading what could not be saved
+	h.SetOverwrite(cfg.policy)
+	if h.Exists(j.dst) {
+		return errors.Wrapf(httpfile.ErrOutputExists, "%s, use -overwrite or -rename", j.dst)
+	}
+	h.SetSync(cfg.sync)
+	err := h.SetOutput(j.dst)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range j.mirrors {
+		err = h.AddMirror(m)
+		if err != nil {
+			d.printf(j, "mirror ignored: %v", err)
+		}
+	}
+
+	if h.Range {
+		err = h.SetWorker(cfg.worker)
+		if err != nil {
+			return err
+		}
+
+		err = h.SetPlanner(cfg.planner)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.direct {
+		err = h.SetDirect(j.dst)
+		if err != nil {
+			return err
+		}
+	}
+
+	policy := httpfile.DefaultRetryPolicy
+	policy.MaxAttempts = cfg.retry
+	err = h.SetRetry(policy)
+	if err != nil {
+		return err
+	}
+
+	h.SetLimiter(cfg.limiter)
+	h.SetConnRateLimit(cfg.connRate)
+	h.SetPool(cfg.pool)
+	h.SetChecksum(j.checksum)
+	return nil
+}
+
+// download :run download of h and report its progress to d
+func download(ctx context.Context, j *job, h *httpfile.HTTPFile, d display) error {
+	sources := len(h.Sources())
+	h.SetObserver(d.observe(j, h))
+	err := h.Run(ctx)
+	d.stop(j, h, err)
+
+	if dropped := sources - len(h.Sources()); dropped > 0 {
+		d.printf(j, "%d source(s) dropped after failures, left: %s", dropped, strings.Join(h.Sources(), ", "))
+	}
+	return err
+}
+
+// parseAuth :headers from -H, -user and -bearer
+func parseAuth(headers []string, userPass, bearer string) (http.Header, error) {
+	header := make(http.Header)
+	for _, s := range headers {
+		k, v, err := parseHeader(s)
+		if err != nil {
+			return nil, err
+		}
+		header.Add(k, v)
+	}
+
+	if len(userPass) != 0 && len(bearer) != 0 {
+		return nil, errors.New("-user and -bearer could not be used together")
+	}
+	if len(userPass) != 0 {
+		if !strings.Contains(userPass, ":") {
+			return nil, errors.New("user must be user:pass")
+		}
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(userPass)))
+	}
+	if len(bearer) != 0 {
+		header.Set("Authorization", "Bearer "+bearer)
+	}
+	return header, nil
+}
+
+// stringList :flag which could be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// overwritePolicy :policy chosen by -overwrite, -no-clobber and -rename,
+// existing files are kept by default
+func overwritePolicy(overwrite, noClobber, rename bool) (httpfile.OverwritePolicy, error) {
+	var n int
+	policy := httpfile.NoClobber
+	for _, f := range []struct {
+		set    bool
+		policy httpfile.OverwritePolicy
+	}{{overwrite, httpfile.Overwrite}, {noClobber, httpfile.NoClobber}, {rename, httpfile.Rename}} {
+		if f.set {
+			n++
+			policy = f.policy
+		}
+	}
+	if n > 1 {
+		return 0, errors.New("-overwrite, -no-clobber and -rename could not be used together")
+	}
+	return policy, nil
+}
+
+// cacheIdentity :identity chosen by -cache-key and -cache-ignore-query
+func cacheIdentity(key, ignoreQuery string) (httpfile.Identity, error) {
+	var id httpfile.Identity
+	switch key {
+	case "url":
+		id.Mode = httpfile.IdentityURL
+	case "url-stripped":
+		id.Mode = httpfile.IdentityStrippedURL
+	case "etag":
+		id.Mode = httpfile.IdentityETag
+	default:
+		return id, errors.Errorf("unknown -cache-key %q, want url, url-stripped or etag", key)
+	}
+
+	for _, name := range strings.Split(ignoreQuery, ",") {
+		if name = strings.TrimSpace(name); len(name) != 0 {
+			id.IgnoreQuery = append(id.IgnoreQuery, name)
+		}
+	}
+	return id, nil
+}
+
+// parseRate :parse bytes per second like 2MB, empty is unlimited
+func parseRate(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	rate, err := httpfile.ParseByteSize(s)
+	return int64(rate), err
 }
 
 func failOnErr(err error) {
@@ -121,11 +529,23 @@ func failOnErr(err error) {
 
 func createDir(dir string) error {
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		return os.Mkdir(dir, BaseDirMode)
+		return os.MkdirAll(dir, BaseDirMode)
 	}
 	return nil
 }
 
+// cacheRoot :dir of cached chunks, -cache-dir wins, then godownloader under
+// XDG_CACHE_HOME, else BaseDir in home
+func cacheRoot(dir, home string) string {
+	if len(dir) != 0 {
+		return dir
+	}
+	if xdg := os.Getenv("XDG_CACHE_HOME"); len(xdg) != 0 {
+		return path.Join(xdg, "godownloader")
+	}
+	return path.Join(home, BaseDir)
+}
+
 func getUserHome() (string, error) {
 	usr, err := user.Current()
 	if err != nil {
@@ -133,11 +553,3 @@ func getUserHome() (string, error) {
 	}
 	return usr.HomeDir, nil
 }
-
-func subLastSlash(str string) string {
-	index := strings.LastIndex(str, "/")
-	if index != -1 {
-		return str[index+1:]
-	}
-	return ""
-}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// netrcLogin :credentials of one machine in .netrc
+type netrcLogin struct {
+	login, password string
+}
+
+// netrc :credentials per host, def applies to any other host
+type netrc struct {
+	machines map[string]netrcLogin
+	def      *netrcLogin
+}
+
+// lookup :credentials for host, nil if there are none
+func (n *netrc) lookup(host string) *netrcLogin {
+	if n == nil {
+		return nil
+	}
+	if l, ok := n.machines[strings.ToLower(host)]; ok {
+		return &l
+	}
+	return n.def
+}
+
+// loadNetrc :read .netrc file name, a missing file is no error unless
+// required
+func loadNetrc(name string, required bool) (*netrc, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "could not open netrc file")
+	}
+	defer f.Close()
+
+	n, err := parseNetrc(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse netrc file: %s", name)
+	}
+	return n, nil
+}
+
+// parseNetrc :parse machine, default, login and password tokens; account is
+// ignored and macdef bodies are skipped up to the next empty line
+func parseNetrc(r io.Reader) (*netrc, error) {
+	n := &netrc{machines: make(map[string]netrcLogin)}
+
+	var (
+		cur     *netrcLogin
+		host    string
+		isDef   bool
+		inMacro bool
+	)
+	done := func() {
+		if cur == nil {
+			return
+		}
+		if isDef {
+			n.def = cur
+		} else if _, ok := n.machines[host]; !ok {
+			// first entry of a machine wins, like curl
+			n.machines[host] = *cur
+		}
+		cur = nil
+	}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if inMacro {
+			if strings.TrimSpace(line) == "" {
+				inMacro = false
+			}
+			continue
+		}
+
+		tokens := strings.Fields(line)
+		for i := 0; i < len(tokens); i++ {
+			tok := tokens[i]
+			if strings.HasPrefix(tok, "#") {
+				break
+			}
+
+			// every keyword but default is followed by a value
+			var value string
+			if tok != "default" {
+				if i+1 >= len(tokens) {
+					return nil, errors.Errorf("missing value after %s", tok)
+				}
+				i++
+				value = tokens[i]
+			}
+
+			switch tok {
+			case "machine":
+				done()
+				cur, host, isDef = &netrcLogin{}, strings.ToLower(value), false
+			case "default":
+				done()
+				cur, host, isDef = &netrcLogin{}, "", true
+			case "login":
+				if cur != nil {
+					cur.login = value
+				}
+			case "password":
+				if cur != nil {
+					cur.password = value
+				}
+			case "account":
+			case "macdef":
+				// macro body starts on next line
+				inMacro = true
+				i = len(tokens)
+			default:
+				return nil, errors.Errorf("unknown token %s", tok)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	done()
+	return n, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+	const file = `# credentials
+machine files.example.com login alice password s3cret
+machine FILES.example.com login mallory password other
+machine mirror.example.com
+	login bob # trailing comment
+	password pw account ignored
+
+macdef init
+machine macro.example.com login eve password fromMacro
+cd /pub
+
+machine after.example.com login carol password c
+default login anonymous password guest@
+`
+	n, err := parseNetrc(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host            string
+		login, password string
+	}{
+		// first entry of a machine wins, host is case insensitive
+		{"files.example.com", "alice", "s3cret"},
+		{"Files.Example.COM", "alice", "s3cret"},
+		{"mirror.example.com", "bob", "pw"},
+		// lines of a macro body are no entries
+		{"macro.example.com", "anonymous", "guest@"},
+		{"after.example.com", "carol", "c"},
+		{"other.example.org", "anonymous", "guest@"},
+	}
+	for _, tt := range tests {
+		l := n.lookup(tt.host)
+		if l == nil || l.login != tt.login || l.password != tt.password {
+			t.Errorf("lookup(%s) = %+v, want %s:%s", tt.host, l, tt.login, tt.password)
+		}
+	}
+
+	// without default only listed machines get credentials
+	n, err = parseNetrc(strings.NewReader("machine a.example.com login u password p\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := n.lookup("b.example.com"); l != nil {
+		t.Errorf("lookup of unlisted host = %+v, want nil", l)
+	}
+	if l := (*netrc)(nil).lookup("a.example.com"); l != nil {
+		t.Errorf("lookup without netrc = %+v, want nil", l)
+	}
+
+	for _, bad := range []string{
+		"machine a.example.com login",
+		"machine a.example.com user u",
+	} {
+		if _, err := parseNetrc(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseNetrc(%q) must fail", bad)
+		}
+	}
+}
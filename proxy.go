@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// proxyConfig :where requests go through, settings of -proxy and -no-proxy
+type proxyConfig struct {
+	// url :proxy of every request, nil takes it from environment
+	url     *url.URL
+	noProxy []string
+	verbose bool
+
+	// reported :hosts whose proxy was reported already
+	reported sync.Map
+}
+
+// parseProxy :parse -proxy url, empty falls back to environment
+func parseProxy(s string) (*url.URL, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.Errorf("proxy scheme must be http, https or socks5, got %q", u.Scheme)
+	}
+	if len(u.Host) == 0 {
+		return nil, errors.Errorf("proxy %s has no host", s)
+	}
+	return u, nil
+}
+
+// parseNoProxy :split comma separated hosts, domains, ip and cidr
+func parseNoProxy(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if len(e) != 0 {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// proxy :proxy for req, nil for a direct connection
+func (p *proxyConfig) proxy(req *http.Request) (*url.URL, error) {
+	var u *url.URL
+	if !p.bypass(req.URL) {
+		if p.url != nil {
+			u = p.url
+		} else {
+			var err error
+			u, err = http.ProxyFromEnvironment(req)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if p.verbose {
+		if _, seen := p.reported.LoadOrStore(req.URL.Host, true); !seen {
+			if u != nil {
+				fmt.Fprintf(os.Stderr, "connect %s via proxy %s\n", req.URL.Host, redact(u))
+			} else {
+				fmt.Fprintf(os.Stderr, "connect %s directly\n", req.URL.Host)
+			}
+		}
+	}
+	return u, nil
+}
+
+// bypass :report whether u matches -no-proxy; an entry is *, a host with
+// optional port, a domain matching its subdomains too, an ip or a cidr
+func (p *proxyConfig) bypass(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	ip := net.ParseIP(host)
+
+	for _, e := range p.noProxy {
+		if e == "*" {
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(e); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		name := e
+		if h, port, err := net.SplitHostPort(e); err == nil {
+			if port != u.Port() {
+				continue
+			}
+			name = h
+		}
+		name = strings.TrimPrefix(name, "[")
+		name = strings.TrimSuffix(name, "]")
+		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "*.") {
+			name = name[strings.Index(name, ".")+1:]
+		}
+		if host == name || strings.HasSuffix(host, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact :u with password hidden
+func redact(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+	if _, ok := u.User.Password(); !ok {
+		return u.String()
+	}
+
+	r := *u
+	r.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return r.String()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestBypass(t *testing.T) {
+	p := &proxyConfig{noProxy: parseNoProxy("localhost, .internal,example.com:8080,10.0.0.0/8,[::1],192.168.1.5")}
+
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"http://localhost/f", true},
+		{"http://LOCALHOST:8099/f", true},
+		{"http://a.internal/f", true},
+		{"http://internal/f", true},
+		{"http://notinternal/f", false},
+		{"http://example.com:8080/f", true},
+		{"http://example.com/f", false},
+		{"http://10.1.2.3/f", true},
+		{"http://11.1.2.3/f", false},
+		{"http://[::1]:80/f", true},
+		{"http://192.168.1.5/f", true},
+		{"http://192.168.1.6/f", false},
+		{"http://example.org/f", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.bypass(u); got != tt.want {
+			t.Errorf("bypass(%s) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+
+	all := &proxyConfig{noProxy: parseNoProxy("*")}
+	if !all.bypass(&url.URL{Scheme: "http", Host: "example.org"}) {
+		t.Error("* must bypass every host")
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	for _, s := range []string{"http://p:3128", "https://p", "socks5://u:p@p:1080"} {
+		if _, err := parseProxy(s); err != nil {
+			t.Errorf("parseProxy(%q): %v", s, err)
+		}
+	}
+	for _, s := range []string{"ftp://p", "http://", "socks4://p:1080"} {
+		if _, err := parseProxy(s); err == nil {
+			t.Errorf("parseProxy(%q) must fail", s)
+		}
+	}
+}
+
+func TestProxyStandIn(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("direct"))
+	}))
+	defer origin.Close()
+
+	// stand-in of an http proxy: requests arrive with the absolute url
+	var seen *http.Request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+		w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := parseProxy("http://pu:pp@" + proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(noProxy, target string) string {
+		pc := &proxyConfig{url: proxyURL, noProxy: parseNoProxy(noProxy)}
+		c := &http.Client{Transport: newTransport(pc, nil)}
+		resp, err := c.Get(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	target := "http://files.example.com/f.bin"
+	if got := get("", target); got != "proxied" {
+		t.Fatalf("%s went %s, want proxied", target, got)
+	}
+	if seen.URL.String() != target {
+		t.Errorf("proxy got %s, want %s", seen.URL, target)
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("pu:pp"))
+	if got := seen.Header.Get("Proxy-Authorization"); got != auth {
+		t.Errorf("Proxy-Authorization = %q, want %q", got, auth)
+	}
+
+	seen = nil
+	if got := get("127.0.0.1,.example.org", origin.URL); got != "direct" || seen != nil {
+		t.Errorf("%s in no-proxy went %s, want direct", origin.URL, got)
+	}
+	if got := get("10.0.0.0/8", origin.URL); got != "proxied" {
+		t.Errorf("%s outside no-proxy went %s, want proxied", origin.URL, got)
+	}
+}
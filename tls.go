@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pinPrefix :only sha256 pins of the public key are supported, like curl
+const pinPrefix = "sha256//"
+
+// tlsOptions :tls settings from command line
+type tlsOptions struct {
+	caCert, caPath string
+	cert, key      string
+	insecure       bool
+	pinnedPubKey   string
+}
+
+// newTLSConfig :tls config of the shared transport, nil keeps go defaults
+func newTLSConfig(o tlsOptions) (*tls.Config, error) {
+	if o == (tlsOptions{}) {
+		return nil, nil
+	}
+	c := &tls.Config{}
+
+	// trust given certificates instead of system ones
+	if len(o.caCert) != 0 || len(o.caPath) != 0 {
+		pool, err := loadCAs(o.caCert, o.caPath)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = pool
+	}
+
+	if len(o.cert) != 0 {
+		key := o.key
+		if len(key) == 0 {
+			// key could be stored in the certificate file
+			key = o.cert
+		}
+		cert, err := tls.LoadX509KeyPair(o.cert, key)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load client certificate")
+		}
+		c.Certificates = []tls.Certificate{cert}
+	} else if len(o.key) != 0 {
+		return nil, errors.New("-key needs -cert")
+	}
+
+	if o.insecure {
+		fmt.Fprintln(os.Stderr, "WARNING: -insecure given, server certificates are NOT verified, anyone in between could read and change the download")
+		c.InsecureSkipVerify = true
+	}
+
+	if len(o.pinnedPubKey) != 0 {
+		pins, err := parsePins(o.pinnedPubKey)
+		if err != nil {
+			return nil, err
+		}
+		c.VerifyPeerCertificate = verifyPins(pins)
+	}
+	return c, nil
+}
+
+// loadCAs :pool of certificates in file and every file of dir
+func loadCAs(file, dir string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if len(file) != 0 {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read ca certificates")
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no certificate found in %s", file)
+		}
+	}
+
+	if len(dir) != 0 {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read ca directory")
+		}
+		var found bool
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			// files without certificates like an index are skipped
+			b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+			if err != nil {
+				return nil, errors.Wrap(err, "could not read ca certificates")
+			}
+			if pool.AppendCertsFromPEM(b) {
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("no certificate found in %s", dir)
+		}
+	}
+	return pool, nil
+}
+
+// parsePins :parse "sha256//<base64>;sha256//<base64>"
+func parsePins(s string) ([]string, error) {
+	var pins []string
+	for _, p := range strings.Split(s, ";") {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, pinPrefix) {
+			return nil, errors.Errorf("pinned public key must be %s<base64>, got %q", pinPrefix, p)
+		}
+		p = p[len(pinPrefix):]
+		b, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(b) != sha256.Size {
+			return nil, errors.Errorf("pinned public key %q is no base64 sha256 digest", p)
+		}
+		pins = append(pins, p)
+	}
+	return pins, nil
+}
+
+// verifyPins :check public key of server certificate matches one of pins
+func verifyPins(pins []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		cert, err := x509.ParseCertificate(raw[0])
+		if err != nil {
+			return errors.Wrap(err, "could not parse server certificate")
+		}
+
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		got := base64.StdEncoding.EncodeToString(sum[:])
+		for _, p := range pins {
+			if p == got {
+				return nil
+			}
+		}
+		return errors.Errorf("public key of %s does not match pinned key, got %s%s", cert.Subject.CommonName, pinPrefix, got)
+	}
+}